@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Decisions on an upgrade waiting for approval
+const (
+	ApprovalApprove = "approve"
+	ApprovalReject  = "reject"
+)
+
+// approvalPollInterval is how often the approval file is checked while waiting
+var approvalPollInterval = time.Second
+
+// ApprovalPath is the file operators write the upgrade name to, to approve it
+func (cfg *Config) ApprovalPath() string {
+	return filepath.Join(cfg.Root(), approvalFile)
+}
+
+// approvalDefault is the decision taken when nobody decides within ApprovalTimeout
+func (cfg *Config) approvalDefault() string {
+	if cfg.ApprovalDefault == "" {
+		return ApprovalReject
+	}
+	return cfg.ApprovalDefault
+}
+
+// waitForApproval blocks until an operator approves or rejects the upgrade to info, or ApprovalTimeout passes
+// (0 waits forever). It returns an error unless the upgrade may go ahead.
+func (cfg *Config) waitForApproval(info *UpgradeInfo) error {
+	start := time.Now()
+	logger.Info("waiting for approval", "upgrade", info.Name, "file", cfg.ApprovalPath(),
+		"timeout", cfg.ApprovalTimeout, "default", cfg.approvalDefault())
+	notifyStatus("upgrade " + info.Name + " waiting for approval")
+	cfg.notify(Notification{Event: NotifyApprovalRequired, Upgrade: info, Target: cfg.UpgradeDir(info.Name)}, nil)
+	// nothing is wedged, we are waiting for a human
+	stopWatchdog := startWatchdog()
+	decision, err := cfg.pollApproval(info.Name)
+	stopWatchdog()
+
+	if err == nil && decision == "" {
+		decision = cfg.approvalDefault()
+		logger.Warn("approval timed out", "upgrade", info.Name, "timeout", cfg.ApprovalTimeout, "decision", decision)
+	}
+	if err == nil && decision == ApprovalReject {
+		err = errors.Errorf("upgrade %s was not approved", info.Name)
+	}
+	if err == nil {
+		logger.Info("upgrade approved", "upgrade", info.Name)
+	}
+	cfg.appendHistory(HistoryRecord{Event: EventApproval, Upgrade: info, NewTarget: cfg.UpgradeDir(info.Name)}, start, err)
+	return err
+}
+
+// pollApproval waits for a decision on the named upgrade in the approval file, consuming it.
+// It returns "" if the timeout passed without a decision.
+func (cfg *Config) pollApproval(name string) (string, error) {
+	var deadline time.Time
+	if cfg.ApprovalTimeout > 0 {
+		deadline = time.Now().Add(cfg.ApprovalTimeout)
+	}
+	for {
+		decision, err := readApproval(cfg.ApprovalPath(), name)
+		if err != nil {
+			return "", err
+		}
+		if decision != "" {
+			// an approval is only good for one upgrade
+			if err := os.Remove(cfg.ApprovalPath()); err != nil {
+				return "", errors.Wrap(err, "removing approval file")
+			}
+			return decision, nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return "", nil
+		}
+		// nobody will approve once we are asked to stop
+		if sig := daemonGroup.stopping(); sig != nil {
+			return "", errors.Errorf("stopped by %s while waiting for approval", sig)
+		}
+		time.Sleep(approvalPollInterval)
+	}
+}
+
+// readApproval returns the decision on the named upgrade in the approval file: the file holds either
+// the upgrade name, or "reject <name>". Decisions on other upgrades are ignored.
+func readApproval(path, name string) (string, error) {
+	bz, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "reading approval file")
+	}
+	// upgrade names may contain spaces, so the whole content is compared
+	switch strings.TrimSpace(string(bz)) {
+	case name:
+		return ApprovalApprove, nil
+	case ApprovalReject + " " + name:
+		return ApprovalReject, nil
+	default:
+		return "", nil
+	}
+}
+
+// writeApproval atomically writes the decision on the named upgrade to the approval file
+func (cfg *Config) writeApproval(name, decision string) error {
+	content := name
+	if decision == ApprovalReject {
+		content = ApprovalReject + " " + name
+	}
+	tmp := cfg.ApprovalPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content+"\n"), 0644); err != nil {
+		return errors.Wrap(err, "writing approval file")
+	}
+	return errors.Wrap(os.Rename(tmp, cfg.ApprovalPath()), "writing approval file")
+}
+
+// ApproveCmd approves (or rejects) an upgrade waiting for approval: `--cosmosd-approve [-reject] <upgrade-name>`.
+// Upgrades may also be approved before they are detected.
+func ApproveCmd(opts Options, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(commandPrefix+"approve", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	reject := flags.Bool("reject", false, "reject the upgrade instead")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: --cosmosd-approve [-reject] <upgrade-name>")
+	}
+
+	cfg, err := GetConfig(opts)
+	if err != nil {
+		return err
+	}
+	name := flags.Arg(0)
+	if *reject {
+		if err := cfg.writeApproval(name, ApprovalReject); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Rejected upgrade %s\n", name)
+		return nil
+	}
+	if err := cfg.writeApproval(name, ApprovalApprove); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Approved upgrade %s\n", name)
+	return nil
+}
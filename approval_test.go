@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForApproval(t *testing.T) {
+	defer func(interval time.Duration) { approvalPollInterval = interval }(approvalPollInterval)
+	approvalPollInterval = 10 * time.Millisecond
+
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", RequireApproval: true}
+	_, err = cfg.CurrentBin()
+	require.NoError(t, err)
+
+	// approved while waiting
+	done := make(chan error)
+	go func() { done <- DoUpgrade(cfg, &UpgradeInfo{Name: "chain2"}) }()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("upgrade did not wait for approval: %v", err)
+	default:
+	}
+	// an approval of another upgrade doesn't count
+	require.NoError(t, cfg.writeApproval("chain3", ApprovalApprove))
+	time.Sleep(50 * time.Millisecond)
+	assertCurrentLink(t, *cfg, "genesis")
+	require.NoError(t, cfg.writeApproval("chain2", ApprovalApprove))
+	require.NoError(t, <-done)
+	assertCurrentLink(t, *cfg, "upgrades/chain2")
+	// the approval was consumed
+	_, err = os.Stat(cfg.ApprovalPath())
+	assert.True(t, os.IsNotExist(err))
+
+	// rejected in advance
+	require.NoError(t, cfg.writeApproval("chain3", ApprovalReject))
+	err = DoUpgrade(cfg, &UpgradeInfo{Name: "chain3"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not approved")
+	assertCurrentLink(t, *cfg, "upgrades/chain2")
+
+	// nobody decides
+	cfg.ApprovalTimeout = 30 * time.Millisecond
+	require.Error(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain3"}))
+	assertCurrentLink(t, *cfg, "upgrades/chain2")
+	cfg.ApprovalDefault = ApprovalApprove
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain3"}))
+	assertCurrentLink(t, *cfg, "upgrades/chain3")
+
+	records, err := cfg.ReadHistory()
+	require.NoError(t, err)
+	var outcomes []string
+	for _, rec := range records {
+		if rec.Event == EventApproval {
+			outcomes = append(outcomes, rec.Upgrade.Name+" "+rec.Outcome)
+		}
+	}
+	assert.Equal(t, []string{"chain2 success", "chain3 failure", "chain3 failure", "chain3 success"}, outcomes)
+}
+
+func TestApproveCmd(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	opts := Options{"home": home, "name": "dummyd"}
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	var out bytes.Buffer
+	require.NoError(t, RunCommand("approve", opts, []string{"chain2"}, &out))
+	assert.Equal(t, "Approved upgrade chain2\n", out.String())
+	decision, err := readApproval(cfg.ApprovalPath(), "chain2")
+	require.NoError(t, err)
+	assert.Equal(t, ApprovalApprove, decision)
+
+	out.Reset()
+	require.NoError(t, RunCommand("approve", opts, []string{"-reject", "chain2"}, &out))
+	assert.Equal(t, "Rejected upgrade chain2\n", out.String())
+	decision, err = readApproval(cfg.ApprovalPath(), "chain2")
+	require.NoError(t, err)
+	assert.Equal(t, ApprovalReject, decision)
+
+	// hand written files work as well
+	require.NoError(t, ioutil.WriteFile(cfg.ApprovalPath(), []byte("  chain3 \n"), 0644))
+	decision, err = readApproval(cfg.ApprovalPath(), "chain3")
+	require.NoError(t, err)
+	assert.Equal(t, ApprovalApprove, decision)
+	decision, err = readApproval(cfg.ApprovalPath(), "chain2")
+	require.NoError(t, err)
+	assert.Equal(t, "", decision)
+
+	// names with spaces
+	out.Reset()
+	require.NoError(t, RunCommand("approve", opts, []string{"-reject", "v2 upgrade"}, &out))
+	assert.Equal(t, "Rejected upgrade v2 upgrade\n", out.String())
+	decision, err = readApproval(cfg.ApprovalPath(), "v2 upgrade")
+	require.NoError(t, err)
+	assert.Equal(t, ApprovalReject, decision)
+	require.NoError(t, RunCommand("approve", opts, []string{"v2 upgrade"}, &out))
+	decision, err = readApproval(cfg.ApprovalPath(), "v2 upgrade")
+	require.NoError(t, err)
+	assert.Equal(t, ApprovalApprove, decision)
+	decision, err = readApproval(cfg.ApprovalPath(), "upgrade")
+	require.NoError(t, err)
+	assert.Equal(t, "", decision)
+
+	require.Error(t, RunCommand("approve", opts, nil, &out))
+	require.Error(t, RunCommand("approve", Options{"home": home, "name": "dummyd", "approval_default": "maybe"},
+		[]string{"chain2"}, &out))
+}
@@ -4,15 +4,23 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 const (
-	rootName    = "upgrade_manager"
-	genesisDir  = "genesis"
-	upgradesDir = "upgrades"
-	currentLink = "current"
+	rootName      = "upgrade_manager"
+	genesisDir    = "genesis"
+	upgradesDir   = "upgrades"
+	currentLink   = "current"
+	previousLink  = "previous"
+	historyFile   = "history.jsonl"
+	daemonPidFile = "daemon.pid"
+	lockFile      = "cosmosd.lock"
+	approvalFile  = "approval"
+	activatedFile = ".activated"
+	pinnedFile    = ".pinned"
 )
 
 // Config is the information passed in to control the daemon
@@ -21,6 +29,43 @@ type Config struct {
 	Name                  string
 	AllowDownloadBinaries bool
 	RestartAfterUpgrade   bool
+	// RetainUpgrades enables pruning after every upgrade, keeping this many previously used versions.
+	// 0 disables automatic pruning.
+	RetainUpgrades int
+	// PinnedUpgrades are never pruned
+	PinnedUpgrades []string
+	// MetricsListen is the address to serve prometheus metrics on, metrics are disabled if empty
+	MetricsListen string
+	// LogLevel, LogFormat and LogOutput configure the events logged by the upgrade manager itself
+	LogLevel  string
+	LogFormat string
+	LogOutput string
+	// WebhookURLs are notified of upgrade events, with an HMAC signature if WebhookSecret is set
+	WebhookURLs   []string
+	WebhookSecret string
+	// OutputDir enables writing the daemon output to rotating files in this directory.
+	// Files are rotated after OutputMaxSize megabytes or OutputRotateEvery, and OutputRetain are kept (0 disables each).
+	OutputDir           string
+	OutputNoPassthrough bool
+	OutputMaxSize       int
+	OutputRotateEvery   time.Duration
+	OutputRetain        int
+	// CheckPorts must be free before the daemon is started (eg. the P2P and RPC ports)
+	CheckPorts []string
+	// MinFreeDisk is the space in megabytes that must stay free on upgrade_manager and DataDir
+	// after downloads, and before switching to an upgrade
+	MinFreeDisk int
+	// DataDir is where the node keeps its database, only used to check the free disk space
+	DataDir string
+	// AllowInsecurePermissions skips refusing binaries that other users could replace
+	AllowInsecurePermissions bool
+	// DryRun runs the daemon and detects upgrades, but only records what an upgrade would do
+	DryRun bool
+	// RequireApproval makes upgrades wait for an operator (see ApprovalPath), after the daemon is stopped and the
+	// binary is prepared. After ApprovalTimeout (0 waits forever), ApprovalDefault (approve or reject) is taken.
+	RequireApproval bool
+	ApprovalTimeout time.Duration
+	ApprovalDefault string
 }
 
 // Root returns the root directory where all info lives
@@ -28,9 +73,14 @@ func (cfg *Config) Root() string {
 	return filepath.Join(cfg.Home, rootName)
 }
 
+// GenesisDir is the directory holding the genesis version
+func (cfg *Config) GenesisDir() string {
+	return filepath.Join(cfg.Root(), genesisDir)
+}
+
 // GenesisBin is the path to the genesis binary - must be in place to start manager
 func (cfg *Config) GenesisBin() string {
-	return filepath.Join(cfg.Root(), genesisDir, "bin", cfg.Name)
+	return filepath.Join(cfg.GenesisDir(), "bin", cfg.Name)
 }
 
 // UpgradeBin is the path to the binary for the named upgrade
@@ -46,7 +96,7 @@ func (cfg *Config) UpgradeDir(upgradeName string) string {
 
 // Symlink to genesis
 func (cfg *Config) SymLinkToGenesis() (string, error) {
-	genesis := filepath.Join(cfg.Root(), genesisDir)
+	genesis := cfg.GenesisDir()
 	link := filepath.Join(cfg.Root(), currentLink)
 
 	if err := os.Symlink(genesis, link); err != nil {
@@ -56,24 +106,25 @@ func (cfg *Config) SymLinkToGenesis() (string, error) {
 	return cfg.GenesisBin(), nil
 }
 
-// CurrentBin is the path to the currently selected binary (genesis if no link is set)
-// This will resolve the symlink to the underlying directory to make it easier to debug
-func (cfg *Config) CurrentBin() (string, error) {
+// CurrentDir returns the directory the current link points to, without creating it.
+// It returns an error if current is missing or not a symlink
+func (cfg *Config) CurrentDir() (string, error) {
 	cur := filepath.Join(cfg.Root(), currentLink)
-	// if nothing here, fallback to genesis
 	info, err := os.Lstat(cur)
 	if err != nil {
-		//Create symlink to the genesis
-		return cfg.SymLinkToGenesis()
+		return "", err
 	}
-	// if it is there, ensure it is a symlink
 	if info.Mode()&os.ModeSymlink == 0 {
-		//Create symlink to the genesis
-		return cfg.SymLinkToGenesis()
+		return "", errors.Errorf("%s is not a symlink", cur)
 	}
+	return os.Readlink(cur)
+}
 
-	// resolve it
-	dest, err := os.Readlink(cur)
+// CurrentBin is the path to the currently selected binary (genesis if no link is set)
+// This will resolve the symlink to the underlying directory to make it easier to debug
+func (cfg *Config) CurrentBin() (string, error) {
+	dest, err := cfg.CurrentDir()
+	// if nothing valid here, fallback to genesis
 	if err != nil {
 		//Create symlink to the genesis
 		return cfg.SymLinkToGenesis()
@@ -84,18 +135,18 @@ func (cfg *Config) CurrentBin() (string, error) {
 	return dest, nil
 }
 
-// GetConfigFromEnv will read the environmental variables into a config
+// GetConfigFromEnv will read the config file and environmental variables into a config
 // and then validate it is reasonable
 func GetConfigFromEnv() (*Config, error) {
-	cfg := &Config{
-		Home: os.Getenv("DAEMON_HOME"),
-		Name: os.Getenv("DAEMON_NAME"),
-	}
-	if os.Getenv("DAEMON_ALLOW_DOWNLOAD_BINARIES") == "on" {
-		cfg.AllowDownloadBinaries = true
-	}
-	if os.Getenv("DAEMON_RESTART_AFTER_UPGRADE") == "on" {
-		cfg.RestartAfterUpgrade = true
+	return GetConfig(nil)
+}
+
+// GetConfig is like GetConfigFromEnv, but command line options take precedence over
+// the environment and the config file
+func GetConfig(opts Options) (*Config, error) {
+	cfg, err := readConfig(opts)
+	if err != nil {
+		return nil, err
 	}
 	if err := cfg.validate(); err != nil {
 		return nil, err
@@ -107,15 +158,8 @@ func GetConfigFromEnv() (*Config, error) {
 // it enforces Home/upgrade_manager is a valid directory and exists,
 // and that Name is set
 func (cfg *Config) validate() error {
-	if cfg.Name == "" {
-		return errors.New("DAEMON_NAME is not set")
-	}
-	if cfg.Home == "" {
-		return errors.New("DAEMON_HOME is not set")
-	}
-
-	if !filepath.IsAbs(cfg.Home) {
-		return errors.New("DAEMON_HOME must be an absolute path")
+	if err := cfg.validateSettings(); err != nil {
+		return err
 	}
 
 	// ensure the root directory exists
@@ -129,3 +173,24 @@ func (cfg *Config) validate() error {
 
 	return nil
 }
+
+// validateSettings checks Name and Home are set properly, without
+// requiring the upgrade_manager directory to exist yet
+func (cfg *Config) validateSettings() error {
+	if cfg.Name == "" {
+		return errors.New("DAEMON_NAME is not set")
+	}
+	if cfg.Home == "" {
+		return errors.New("DAEMON_HOME is not set")
+	}
+
+	if !filepath.IsAbs(cfg.Home) {
+		return errors.New("DAEMON_HOME must be an absolute path")
+	}
+	switch cfg.ApprovalDefault {
+	case "", ApprovalApprove, ApprovalReject:
+	default:
+		return errors.Errorf("DAEMON_APPROVAL_DEFAULT must be %s or %s", ApprovalApprove, ApprovalReject)
+	}
+	return nil
+}
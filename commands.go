@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// commandPrefix marks the first argument as a cosmosd command rather than an argument
+// for the daemon, eg. `cosmosd --cosmosd-status`. Anything else is passed through untouched.
+const commandPrefix = "--cosmosd-"
+
+// Version of cosmosd, set at build time with -ldflags "-X main.Version=..."
+var Version = "dev"
+
+// Command is a cosmosd command that works on the upgrade_manager layout instead of
+// launching the daemon. opts are the --cosmosd.<key> options given on the command line,
+// args are the remaining arguments after the command name.
+type Command func(opts Options, args []string, stdout io.Writer) error
+
+var commands = map[string]Command{
+	"approve":   ApproveCmd,
+	"doctor":    DoctorCmd,
+	"history":   HistoryCmd,
+	"init":      InitCmd,
+	"install":   InstallCmd,
+	"instances": InstancesCmd,
+	"prune":     PruneCmd,
+	"rollback":  RollbackCmd,
+	"status":    StatusCmd,
+	"supervise": SuperviseCmd,
+	"version":   VersionCmd,
+}
+
+func init() {
+	// help lists all commands, so it cannot be part of the map literal
+	commands["help"] = HelpCmd
+}
+
+// ParseCommand returns the name of the cosmosd command if args start with one
+func ParseCommand(args []string) (string, bool) {
+	if len(args) == 0 || !strings.HasPrefix(args[0], commandPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(args[0], commandPrefix), true
+}
+
+// RunCommand executes the named cosmosd command
+func RunCommand(name string, opts Options, args []string, stdout io.Writer) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return errors.Errorf("unknown command %s%s (available: %s)", commandPrefix, name, strings.Join(commandNames(), ", "))
+	}
+	return cmd(opts, args, stdout)
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, commandPrefix+name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// VersionCmd prints the version of cosmosd itself (`<daemon> version` is passed through as usual)
+func VersionCmd(_ Options, _ []string, stdout io.Writer) error {
+	_, err := fmt.Fprintf(stdout, "cosmosd %s\n", Version)
+	return err
+}
+
+// HelpCmd prints the usage of cosmosd itself
+func HelpCmd(_ Options, _ []string, stdout io.Writer) error {
+	fmt.Fprintf(stdout, `Usage:
+  cosmosd [%s<option>=<value>...] <daemon arguments...>
+  cosmosd [%s<option>=<value>...] %s<command> [command flags]
+
+All arguments are passed to the daemon, except for the cosmosd options, which may appear anywhere.
+Options take precedence over environmental variables, which take precedence over the config file
+($DAEMON_HOME/%s/%s or $%s).
+
+Options:
+`, optionPrefix, optionPrefix, commandPrefix, rootName, configFile, configEnv)
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "  %s%s\t%s\t%s\n", optionPrefix, configOption, configEnv, "path of the config file")
+	for _, s := range settings {
+		fmt.Fprintf(tw, "  %s%s\t%s\t%s\n", optionPrefix, s.key, s.env, s.usage)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "\nCommands (use -h for their flags):\n")
+	for _, name := range commandNames() {
+		fmt.Fprintf(stdout, "  %s\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCommand(t *testing.T) {
+	name, ok := ParseCommand([]string{"--cosmosd-status", "-json"})
+	assert.True(t, ok)
+	assert.Equal(t, "status", name)
+
+	_, ok = ParseCommand([]string{"start", "--cosmosd-status"})
+	assert.False(t, ok)
+	_, ok = ParseCommand(nil)
+	assert.False(t, ok)
+}
+
+func TestHelpAndVersion(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, RunCommand("help", nil, nil, &out))
+	for _, s := range settings {
+		assert.Contains(t, out.String(), optionPrefix+s.key)
+		assert.Contains(t, out.String(), s.env)
+	}
+	assert.Contains(t, out.String(), "--cosmosd-status")
+	assert.Contains(t, out.String(), "--cosmosd-help")
+
+	out.Reset()
+	require.NoError(t, RunCommand("version", nil, nil, &out))
+	assert.Equal(t, "cosmosd dev\n", out.String())
+
+	require.Error(t, RunCommand("no-such-command", nil, nil, &out))
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// configFile is the default location of the config file under upgrade_manager
+	configFile = "config.yaml"
+	// configEnv can point to a config file in another location
+	configEnv = "DAEMON_CONFIG"
+	// configOption does the same on the command line, --cosmosd.config=<path>
+	configOption = "config"
+	// optionPrefix marks arguments for cosmosd itself, they are never passed to the daemon
+	optionPrefix = "--cosmosd."
+)
+
+// setting is one configuration option. Every option can be set in the config file (under key),
+// with an environmental variable (env) or on the command line (--cosmosd.<key>=<value>).
+type setting struct {
+	key   string
+	env   string
+	usage string
+	setter
+}
+
+// setter parses the value of a setting into the config
+type setter struct {
+	set func(cfg *Config, value string) error
+	// boolean settings may be given on the command line without a value
+	boolean bool
+}
+
+// settings lists all configuration options, new options only need to be added here
+var settings = []setting{
+	{"home", "DAEMON_HOME", "directory holding the upgrade_manager folder",
+		stringSetting(func(cfg *Config) *string { return &cfg.Home })},
+	{"name", "DAEMON_NAME", "name of the daemon binary",
+		stringSetting(func(cfg *Config) *string { return &cfg.Name })},
+	{"allow_download_binaries", "DAEMON_ALLOW_DOWNLOAD_BINARIES", "auto-download missing upgrade binaries",
+		boolSetting(func(cfg *Config) *bool { return &cfg.AllowDownloadBinaries })},
+	{"restart_after_upgrade", "DAEMON_RESTART_AFTER_UPGRADE", "restart the daemon after a successful upgrade",
+		boolSetting(func(cfg *Config) *bool { return &cfg.RestartAfterUpgrade })},
+	{"retain_upgrades", "DAEMON_RETAIN_UPGRADES", "prune after every upgrade, keeping this many previous versions",
+		intSetting(func(cfg *Config) *int { return &cfg.RetainUpgrades })},
+	{"pinned_upgrades", "DAEMON_PINNED_UPGRADES", "comma-separated upgrades that are never pruned",
+		listSetting(func(cfg *Config) *[]string { return &cfg.PinnedUpgrades })},
+	{"metrics_listen", "DAEMON_METRICS_LISTEN", "address to serve prometheus metrics on (eg. localhost:26661)",
+		stringSetting(func(cfg *Config) *string { return &cfg.MetricsListen })},
+	{"log_level", "DAEMON_LOG_LEVEL", "minimum level of cosmosd events to log: debug, info, warn or error",
+		stringSetting(func(cfg *Config) *string { return &cfg.LogLevel })},
+	{"log_format", "DAEMON_LOG_FORMAT", "format of cosmosd events: logfmt or json",
+		stringSetting(func(cfg *Config) *string { return &cfg.LogFormat })},
+	{"log_output", "DAEMON_LOG_OUTPUT", "where to log cosmosd events: stderr, syslog or a file path",
+		stringSetting(func(cfg *Config) *string { return &cfg.LogOutput })},
+	{"webhook_urls", "DAEMON_WEBHOOK_URLS", "comma-separated urls to post upgrade events to",
+		listSetting(func(cfg *Config) *[]string { return &cfg.WebhookURLs })},
+	{"webhook_secret", "DAEMON_WEBHOOK_SECRET", "key for the HMAC signature of webhook notifications",
+		stringSetting(func(cfg *Config) *string { return &cfg.WebhookSecret })},
+	{"output_dir", "DAEMON_OUTPUT_DIR", "directory to write the daemon stdout and stderr to, in rotating files",
+		stringSetting(func(cfg *Config) *string { return &cfg.OutputDir })},
+	{"output_no_passthrough", "DAEMON_OUTPUT_NO_PASSTHROUGH", "only write the daemon output to output_dir, not to our stdout and stderr",
+		boolSetting(func(cfg *Config) *bool { return &cfg.OutputNoPassthrough })},
+	{"output_max_size", "DAEMON_OUTPUT_MAX_SIZE", "rotate output files larger than this many megabytes",
+		intSetting(func(cfg *Config) *int { return &cfg.OutputMaxSize })},
+	{"output_rotate_every", "DAEMON_OUTPUT_ROTATE_EVERY", "rotate output files older than this duration (eg. 24h)",
+		durationSetting(func(cfg *Config) *time.Duration { return &cfg.OutputRotateEvery })},
+	{"output_retain", "DAEMON_OUTPUT_RETAIN", "number of compressed rotated output files to keep",
+		intSetting(func(cfg *Config) *int { return &cfg.OutputRetain })},
+	{"check_ports", "DAEMON_CHECK_PORTS", "comma-separated ports which must be free before starting the daemon (eg. 26656,26657)",
+		listSetting(func(cfg *Config) *[]string { return &cfg.CheckPorts })},
+	{"min_free_disk", "DAEMON_MIN_FREE_DISK", "megabytes that must stay free after downloads and before upgrades",
+		intSetting(func(cfg *Config) *int { return &cfg.MinFreeDisk })},
+	{"data_dir", "DAEMON_DATA_DIR", "data directory of the node, checked for min_free_disk as well",
+		stringSetting(func(cfg *Config) *string { return &cfg.DataDir })},
+	{"allow_insecure_permissions", "DAEMON_ALLOW_INSECURE_PERMISSIONS",
+		"run binaries even if other users could replace them (group or world writable, or owned by another user)",
+		boolSetting(func(cfg *Config) *bool { return &cfg.AllowInsecurePermissions })},
+	{"dry_run", "DAEMON_DRY_RUN", "never stop the daemon, download or switch binaries, only record what an upgrade would do",
+		boolSetting(func(cfg *Config) *bool { return &cfg.DryRun })},
+	{"require_approval", "DAEMON_REQUIRE_APPROVAL", "wait for --cosmosd-approve before switching to an upgrade",
+		boolSetting(func(cfg *Config) *bool { return &cfg.RequireApproval })},
+	{"approval_timeout", "DAEMON_APPROVAL_TIMEOUT", "how long to wait for an approval (eg. 2h), 0 waits forever",
+		durationSetting(func(cfg *Config) *time.Duration { return &cfg.ApprovalTimeout })},
+	{"approval_default", "DAEMON_APPROVAL_DEFAULT", "decision when the approval times out: approve or reject (default)",
+		stringSetting(func(cfg *Config) *string { return &cfg.ApprovalDefault })},
+}
+
+func findSetting(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// readConfig builds the config without validating it. The precedence is command line options,
+// then environmental variables, then the config file, then defaults.
+func readConfig(opts Options) (*Config, error) {
+	env := map[string]string{}
+	for _, s := range settings {
+		if value := os.Getenv(s.env); value != "" {
+			env[s.key] = value
+		}
+	}
+	flags := make(map[string]string, len(opts))
+	for key, value := range opts {
+		if key != configOption {
+			flags[key] = value
+		}
+	}
+
+	home := env["home"]
+	if flags["home"] != "" {
+		home = flags["home"]
+	}
+
+	cfg := &Config{}
+	path, explicit := configPath(opts[configOption], home)
+	if path != "" {
+		file, err := readConfigFile(path)
+		if os.IsNotExist(errors.Cause(err)) && !explicit {
+			// the default config file is optional
+			file = nil
+		} else if err != nil {
+			return nil, err
+		}
+		if err := applySettings(cfg, file, path); err != nil {
+			return nil, err
+		}
+	}
+	if err := applySettings(cfg, env, "environment"); err != nil {
+		return nil, err
+	}
+	if err := applySettings(cfg, flags, "command line"); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configPath returns the path of the config file, and whether it was explicitly requested
+// (rather than the default location under upgrade_manager, which may not exist)
+func configPath(option, home string) (string, bool) {
+	if option != "" {
+		return option, true
+	}
+	if path := os.Getenv(configEnv); path != "" {
+		return path, true
+	}
+	if home == "" {
+		return "", false
+	}
+	return filepath.Join(home, rootName, configFile), false
+}
+
+// Options are the settings given on the command line as --cosmosd.<key>=<value>,
+// by setting key (eg. allow_download_binaries), plus the config file path under "config"
+type Options map[string]string
+
+// ParseOptions strips all --cosmosd.<key>[=<value>] arguments from args and returns them as options,
+// along with the remaining arguments for the daemon. A boolean option without value is set to true (other
+// options need one), and dashes in the key are treated as underscores (--cosmosd.allow-download-binaries).
+// Parsing stops at "--", which is passed on to the daemon along with everything after it.
+func ParseOptions(args []string) (Options, []string, error) {
+	opts := Options{}
+	rest := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, optionPrefix) {
+			rest = append(rest, arg)
+			continue
+		}
+		key, value, hasValue := strings.TrimPrefix(arg, optionPrefix), "true", false
+		if i := strings.Index(key, "="); i >= 0 {
+			key, value, hasValue = key[:i], key[i+1:], true
+		}
+		key = strings.Replace(key, "-", "_", -1)
+		s, ok := findSetting(key)
+		if !ok && key != configOption {
+			return nil, nil, errors.Errorf("unknown option %s (see %shelp)", arg, commandPrefix)
+		}
+		if !hasValue && !s.boolean {
+			return nil, nil, errors.Errorf("option %s needs a value (%s%s=<value>)", arg, optionPrefix, key)
+		}
+		opts[key] = value
+	}
+	return opts, rest, nil
+}
+
+// readConfigFile parses a yaml config file into setting values. Unknown keys are an error.
+func readConfigFile(path string) (map[string]string, error) {
+	bz, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(bz, &raw); err != nil {
+		return nil, errors.Wrapf(err, "parsing config file %s", path)
+	}
+	return settingValues(raw, "config file "+path)
+}
+
+// settingValues converts parsed yaml into setting values, source is used to report errors
+func settingValues(raw map[string]interface{}, source string) (map[string]string, error) {
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		if _, ok := findSetting(key); !ok {
+			return nil, errors.Errorf("unknown key %q in %s", key, source)
+		}
+		str, err := settingValue(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s in %s", key, source)
+		}
+		values[key] = str
+	}
+	return values, nil
+}
+
+// settingValue converts a yaml value into the string form also used by environmental variables
+func settingValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			str, err := settingValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = str
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", errors.Errorf("unsupported value %v", value)
+	}
+}
+
+// applySettings sets all values on the config, source is used to report errors
+func applySettings(cfg *Config, values map[string]string, source string) error {
+	// apply in a stable order, so errors are reproducible
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s, ok := findSetting(key)
+		if !ok {
+			return errors.Errorf("unknown setting %q in %s", key, source)
+		}
+		if err := s.set(cfg, values[key]); err != nil {
+			return errors.Wrapf(err, "invalid %s (%s) in %s", s.key, s.env, source)
+		}
+	}
+	return nil
+}
+
+func stringSetting(field func(*Config) *string) setter {
+	return setter{set: func(cfg *Config, value string) error {
+		*field(cfg) = value
+		return nil
+	}}
+}
+
+func boolSetting(field func(*Config) *bool) setter {
+	return setter{boolean: true, set: func(cfg *Config, value string) error {
+		b, err := parseBool(value)
+		*field(cfg) = b
+		return err
+	}}
+}
+
+func intSetting(field func(*Config) *int) setter {
+	return setter{set: func(cfg *Config, value string) error {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			return errors.Errorf("must be a non-negative number, got %q", value)
+		}
+		*field(cfg) = n
+		return nil
+	}}
+}
+
+func durationSetting(field func(*Config) *time.Duration) setter {
+	return setter{set: func(cfg *Config, value string) error {
+		if strings.TrimSpace(value) == "" {
+			*field(cfg) = 0
+			return nil
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d < 0 {
+			return errors.Errorf("must be a non-negative duration (eg. 24h), got %q", value)
+		}
+		*field(cfg) = d
+		return nil
+	}}
+}
+
+func listSetting(field func(*Config) *[]string) setter {
+	return setter{set: func(cfg *Config, value string) error {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(cfg) = list
+		return nil
+	}}
+}
+
+// parseBool accepts the usual spellings of booleans: true/1/yes/on and false/0/no/off
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "1", "yes", "on":
+		return true, nil
+	case "false", "0", "no", "off", "":
+		return false, nil
+	default:
+		return false, errors.Errorf("must be a boolean (true/1/yes/on or false/0/no/off), got %q", value)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadConfig(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	other := filepath.Join(home, "other.yaml")
+	require.NoError(t, ioutil.WriteFile(other, []byte("home: "+home+"\nname: otherd\n"), 0644))
+
+	cases := map[string]struct {
+		env    map[string]string
+		file   string
+		expect Config
+		isErr  bool
+	}{
+		"env only": {
+			env:    map[string]string{"DAEMON_HOME": home, "DAEMON_NAME": "dummyd", "DAEMON_ALLOW_DOWNLOAD_BINARIES": "on"},
+			expect: Config{Home: home, Name: "dummyd", AllowDownloadBinaries: true},
+		},
+		"file only": {
+			env: map[string]string{"DAEMON_HOME": home},
+			file: "name: dummyd\nallow_download_binaries: yes\nrestart_after_upgrade: 1\nretain_upgrades: 3\n" +
+				"pinned_upgrades: [chain2, chain3]\n",
+			expect: Config{Home: home, Name: "dummyd", AllowDownloadBinaries: true, RestartAfterUpgrade: true,
+				RetainUpgrades: 3, PinnedUpgrades: []string{"chain2", "chain3"}},
+		},
+		"env overrides file": {
+			env:    map[string]string{"DAEMON_HOME": home, "DAEMON_NAME": "envd", "DAEMON_RESTART_AFTER_UPGRADE": "false"},
+			file:   "name: filed\nrestart_after_upgrade: true\n",
+			expect: Config{Home: home, Name: "envd"},
+		},
+		"lenient booleans": {
+			env:    map[string]string{"DAEMON_HOME": home, "DAEMON_NAME": "dummyd", "DAEMON_ALLOW_DOWNLOAD_BINARIES": "TRUE", "DAEMON_RESTART_AFTER_UPGRADE": "Yes"},
+			expect: Config{Home: home, Name: "dummyd", AllowDownloadBinaries: true, RestartAfterUpgrade: true},
+		},
+		"explicit config file": {
+			env:    map[string]string{"DAEMON_CONFIG": other},
+			expect: Config{Home: home, Name: "otherd"},
+		},
+		"missing explicit config file": {
+			env:   map[string]string{"DAEMON_CONFIG": filepath.Join(home, "missing.yaml")},
+			isErr: true,
+		},
+		"unknown key": {
+			env:   map[string]string{"DAEMON_HOME": home, "DAEMON_NAME": "dummyd"},
+			file:  "name: dummyd\nallow_downloads: true\n",
+			isErr: true,
+		},
+		"invalid boolean": {
+			env:   map[string]string{"DAEMON_HOME": home, "DAEMON_NAME": "dummyd", "DAEMON_ALLOW_DOWNLOAD_BINARIES": "sure"},
+			isErr: true,
+		},
+		"invalid number": {
+			env:   map[string]string{"DAEMON_HOME": home, "DAEMON_NAME": "dummyd"},
+			file:  "retain_upgrades: many\n",
+			isErr: true,
+		},
+		"malformed file": {
+			env:   map[string]string{"DAEMON_HOME": home, "DAEMON_NAME": "dummyd"},
+			file:  "name: [dummyd\n",
+			isErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			for _, s := range settings {
+				os.Unsetenv(s.env)
+			}
+			os.Unsetenv(configEnv)
+			for k, v := range tc.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			path := filepath.Join(home, rootName, configFile)
+			os.Remove(path)
+			if tc.file != "" {
+				require.NoError(t, ioutil.WriteFile(path, []byte(tc.file), 0644))
+			}
+
+			cfg, err := GetConfigFromEnv()
+			if tc.isErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, *cfg)
+		})
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	cases := map[string]struct {
+		args  []string
+		opts  Options
+		rest  []string
+		isErr bool
+	}{
+		"no options": {
+			args: []string{"start", "--home", "/foo"},
+			opts: Options{},
+			rest: []string{"start", "--home", "/foo"},
+		},
+		"options anywhere": {
+			args: []string{"--cosmosd.name=gaiad", "start", "--cosmosd.allow-download-binaries", "--home=/foo", "--cosmosd.config=/etc/c.yaml"},
+			opts: Options{"name": "gaiad", "allow_download_binaries": "true", "config": "/etc/c.yaml"},
+			rest: []string{"start", "--home=/foo"},
+		},
+		"empty value": {
+			args: []string{"--cosmosd.pinned_upgrades=", "start"},
+			opts: Options{"pinned_upgrades": ""},
+			rest: []string{"start"},
+		},
+		"unknown option": {
+			args:  []string{"--cosmosd.nope=1", "start"},
+			isErr: true,
+		},
+		"missing value": {
+			args:  []string{"--cosmosd.name", "gaiad", "start"},
+			isErr: true,
+		},
+		"stops at double dash": {
+			args: []string{"--cosmosd.dry_run", "start", "--", "--cosmosd.name=gaiad", "--x"},
+			opts: Options{"dry_run": "true"},
+			rest: []string{"start", "--", "--cosmosd.name=gaiad", "--x"},
+		},
+		"missing config path": {
+			args:  []string{"--cosmosd.config", "start"},
+			isErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			opts, rest, err := ParseOptions(tc.args)
+			if tc.isErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.opts, opts)
+			assert.Equal(t, tc.rest, rest)
+		})
+	}
+}
+
+func TestSettingBoolean(t *testing.T) {
+	var bools []string
+	for _, s := range settings {
+		if s.boolean {
+			bools = append(bools, s.key)
+		}
+	}
+	assert.Contains(t, bools, "allow_download_binaries")
+	assert.Contains(t, bools, "dry_run")
+	for _, key := range []string{"name", "retain_upgrades", "pinned_upgrades", "approval_timeout"} {
+		assert.NotContains(t, bools, key)
+	}
+}
+
+func TestOptionsPrecedence(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	path := filepath.Join(home, "custom.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("name: filed\nretain_upgrades: 2\nrestart_after_upgrade: true\n"), 0644))
+	os.Setenv("DAEMON_NAME", "envd")
+	os.Setenv("DAEMON_RETAIN_UPGRADES", "3")
+	defer os.Unsetenv("DAEMON_NAME")
+	defer os.Unsetenv("DAEMON_RETAIN_UPGRADES")
+
+	opts := Options{"home": home, "config": path, "retain_upgrades": "4"}
+	cfg, err := GetConfig(opts)
+	require.NoError(t, err)
+	assert.Equal(t, Config{Home: home, Name: "envd", RestartAfterUpgrade: true, RetainUpgrades: 4}, *cfg)
+
+	_, err = GetConfig(Options{"home": home, "config": path, "allow_download_binaries": "maybe"})
+	require.Error(t, err)
+}
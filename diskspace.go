@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	megabyte = 1024 * 1024
+	// headTimeout bounds how long we wait for the size of a download
+	headTimeout = 10 * time.Second
+)
+
+// diskFree returns the bytes available to us on the filesystem holding path
+var diskFree = func(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, errors.Wrapf(err, "checking free space on %s", path)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// checkDiskSpace makes sure need bytes fit in upgrade_manager, leaving at least the configured minimum free
+// there and on the data dir. The node database is corrupted when its disk runs full, so it is better to fail
+// an upgrade (or a download) than to fill the disk.
+func (cfg *Config) checkDiskSpace(need int64, what string) error {
+	min := int64(cfg.MinFreeDisk) * megabyte
+	if err := checkFree(cfg.Root(), need, min, what); err != nil {
+		return err
+	}
+	if cfg.DataDir != "" {
+		return checkFree(cfg.DataDir, 0, min, what)
+	}
+	return nil
+}
+
+func checkFree(path string, need, min int64, what string) error {
+	free, err := diskFree(path)
+	if err != nil {
+		return err
+	}
+	if free < need+min {
+		return errors.Errorf("not enough disk space for %s on %s: %s free, need %s plus %s to keep free (DAEMON_MIN_FREE_DISK)",
+			what, path, formatBytes(free), formatBytes(need), formatBytes(min))
+	}
+	return nil
+}
+
+// artifactSize returns the size of what src points to, if it can be found out before downloading:
+// the Content-Length of an http(s) url, or the size of a local file. It returns 0 otherwise.
+func artifactSize(src, pwd string) int64 {
+	u, err := url.Parse(src)
+	if err != nil {
+		return 0
+	}
+	switch u.Scheme {
+	case "http", "https":
+		client := &http.Client{Timeout: headTimeout}
+		res, err := client.Head(src)
+		if err != nil {
+			return 0
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || res.ContentLength < 0 {
+			return 0
+		}
+		return res.ContentLength
+	case "", "file":
+		path := u.Path
+		if pwd != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(pwd, path)
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			return 0
+		}
+		return info.Size()
+	default:
+		return 0
+	}
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1024*megabyte:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1024*megabyte))
+	case n >= megabyte:
+		return fmt.Sprintf("%.1f MiB", float64(n)/megabyte)
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
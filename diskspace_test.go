@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDiskFree pretends every filesystem has free bytes available
+func fakeDiskFree(free int64) func() {
+	orig := diskFree
+	diskFree = func(string) (int64, error) { return free, nil }
+	return func() { diskFree = orig }
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	cfg := &Config{Home: "/home/node", Name: "dummyd", MinFreeDisk: 100}
+	defer fakeDiskFree(150 * megabyte)()
+
+	require.NoError(t, cfg.checkDiskSpace(50*megabyte, "downloading chain2"))
+	err := cfg.checkDiskSpace(51*megabyte, "downloading chain2")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not enough disk space for downloading chain2 on /home/node/upgrade_manager: 150.0 MiB free, need 51.0 MiB")
+
+	// the data dir only needs the minimum free
+	cfg.DataDir = "/data"
+	diskFree = func(path string) (int64, error) {
+		if path == "/data" {
+			return 99 * megabyte, nil
+		}
+		return 150 * megabyte, nil
+	}
+	err = cfg.checkDiskSpace(0, "upgrade chain2")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "on /data: 99.0 MiB free")
+	cfg.MinFreeDisk = 99
+	require.NoError(t, cfg.checkDiskSpace(0, "upgrade chain2"))
+}
+
+func TestDiskFree(t *testing.T) {
+	free, err := diskFree(os.TempDir())
+	require.NoError(t, err)
+	assert.True(t, free > 0)
+	_, err = diskFree("/non/existing")
+	require.Error(t, err)
+}
+
+func TestArtifactSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", "4096")
+	}))
+	defer server.Close()
+	assert.Equal(t, int64(4096), artifactSize(server.URL+"/gaiad", ""))
+	assert.Equal(t, int64(0), artifactSize(server.URL+"/missing", ""))
+
+	dir, err := ioutil.TempDir("", "artifact-size")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "gaiad"), make([]byte, 1000), 0755))
+	assert.Equal(t, int64(1000), artifactSize(filepath.Join(dir, "gaiad"), ""))
+	assert.Equal(t, int64(1000), artifactSize("gaiad", dir))
+	assert.Equal(t, int64(1000), artifactSize("file://"+filepath.Join(dir, "gaiad"), ""))
+	assert.Equal(t, int64(0), artifactSize(dir, ""))
+	assert.Equal(t, int64(0), artifactSize("git::https://github.com/cosmos/gaia", ""))
+}
+
+func TestUpgradeNeedsDiskSpace(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", MinFreeDisk: 1}
+	defer fakeDiskFree(megabyte / 2)()
+
+	err = DoUpgrade(cfg, &UpgradeInfo{Name: "chain2"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not enough disk space for upgrade chain2")
+	// current was not touched
+	_, err = cfg.CurrentDir()
+	require.Error(t, err)
+
+	_, err = InstallUpgrade(cfg, "chain4", cfg.UpgradeBin("chain2"), false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not enough disk space for installing chain4")
+
+	// bootstrapping checks as well
+	_, err = InitLayout(cfg, cfg.UpgradeBin("chain2"), true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not enough disk space for installing genesis")
+	manifest := filepath.Join(home, "manifest.json")
+	require.NoError(t, ioutil.WriteFile(manifest, []byte(`{"upgrades": {"chain4": "`+cfg.UpgradeBin("chain2")+`"}}`), 0644))
+	_, err = InstallManifest(cfg, manifest, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not enough disk space for installing chain4")
+}
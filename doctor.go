@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// Severity of a doctor finding
+type Severity string
+
+const (
+	// SeverityError means the manager will fail to start or to upgrade
+	SeverityError Severity = "error"
+	// SeverityWarning means the layout works but is unsafe or untidy
+	SeverityWarning Severity = "warning"
+	// SeverityInfo is purely informational
+	SeverityInfo Severity = "info"
+)
+
+// Finding is one problem discovered by Diagnose, along with a suggested fix
+type Finding struct {
+	Severity Severity `json:"severity"`
+	Check    string   `json:"check"`
+	Path     string   `json:"path"`
+	Message  string   `json:"message"`
+	Fix      string   `json:"fix,omitempty"`
+}
+
+// Diagnose checks the whole upgrade_manager layout and returns all findings.
+// An empty result means everything looks fine.
+func Diagnose(cfg *Config) []Finding {
+	var d diagnosis
+
+	root := cfg.Root()
+	info, err := os.Stat(root)
+	if err != nil || !info.IsDir() {
+		d.add(SeverityError, "layout", root, "upgrade_manager directory is missing",
+			fmt.Sprintf("create %s and install the genesis binary under %s", root, cfg.GenesisBin()))
+		return d.findings
+	}
+	// the parents of root may allow replacing the whole folder
+	for p := filepath.Dir(root); ; p = filepath.Dir(p) {
+		d.checkWritable(cfg, p)
+		if p == filepath.Dir(p) {
+			break
+		}
+	}
+	d.checkWritable(cfg, root)
+
+	d.checkVersion(cfg, "genesis", cfg.GenesisDir(), cfg.GenesisBin())
+	d.checkUpgrades(cfg)
+	d.checkCurrent(cfg)
+	return d.findings
+}
+
+type diagnosis struct {
+	findings []Finding
+}
+
+func (d *diagnosis) add(severity Severity, check, path, msg, fix string) {
+	d.findings = append(d.findings, Finding{Severity: severity, Check: check, Path: path, Message: msg, Fix: fix})
+}
+
+// checkVersion verifies a version directory holds a binary that can run on this host
+func (d *diagnosis) checkVersion(cfg *Config, check, dir, bin string) {
+	d.checkWritable(cfg, dir)
+	d.checkWritable(cfg, filepath.Dir(bin))
+	if err := ensureExecutable(bin); err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			d.add(SeverityError, check, bin, "binary is missing",
+				fmt.Sprintf("place the %s binary at %s", cfg.Name, bin))
+		} else {
+			d.add(SeverityError, check, bin, err.Error(), fmt.Sprintf("chmod 0755 %s", bin))
+		}
+		return
+	}
+	d.checkWritable(cfg, bin)
+	if err := checkArch(bin); err != nil {
+		d.add(SeverityError, check, bin, err.Error(),
+			fmt.Sprintf("replace it with a build for %s", osArch()))
+	}
+}
+
+// checkUpgrades looks at every entry under upgrades/
+func (d *diagnosis) checkUpgrades(cfg *Config) {
+	dir := filepath.Join(cfg.Root(), upgradesDir)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		d.add(SeverityInfo, "upgrades", dir, "no upgrades directory", "")
+		return
+	}
+	if err != nil {
+		d.add(SeverityError, "upgrades", dir, err.Error(), "")
+		return
+	}
+	d.checkWritable(cfg, dir)
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		switch {
+		case strings.HasPrefix(entry.Name(), stagingPrefix):
+			d.add(SeverityWarning, "partial-download", path, "leftover of an interrupted install",
+				fmt.Sprintf("rm -rf %s", path))
+		case !entry.IsDir():
+			d.add(SeverityWarning, "upgrades", path, "unexpected file in upgrades directory",
+				fmt.Sprintf("remove %s", path))
+		default:
+			name, err := url.PathUnescape(entry.Name())
+			if err != nil || url.PathEscape(name) != entry.Name() {
+				d.add(SeverityError, "upgrades", path, "directory name is not the URI-encoded upgrade name",
+					fmt.Sprintf("rename it to %s", filepath.Join(dir, url.PathEscape(entry.Name()))))
+				continue
+			}
+			d.checkUpgrade(cfg, name)
+		}
+	}
+}
+
+// checkUpgrade checks a single upgrade directory. A directory without a binary is usually a partial download,
+// and it blocks auto-download, which never overwrites an existing directory.
+func (d *diagnosis) checkUpgrade(cfg *Config, name string) {
+	bin := cfg.UpgradeBin(name)
+	if _, err := os.Stat(bin); os.IsNotExist(err) {
+		d.add(SeverityError, "partial-download", bin, "upgrade directory has no binary",
+			fmt.Sprintf("rm -rf %s, or run cosmosd --cosmosd-install %q <binary>", cfg.UpgradeDir(name), name))
+		return
+	}
+	d.checkVersion(cfg, "upgrade", cfg.UpgradeDir(name), bin)
+}
+
+// checkCurrent ensures current is a symlink to a valid version directory
+func (d *diagnosis) checkCurrent(cfg *Config) {
+	link := filepath.Join(cfg.Root(), currentLink)
+	info, err := os.Lstat(link)
+	if os.IsNotExist(err) {
+		d.add(SeverityInfo, "current", link, "current is not linked yet, it will point to genesis on first start", "")
+		return
+	}
+	if err != nil {
+		d.add(SeverityError, "current", link, err.Error(), "")
+		return
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		d.add(SeverityError, "current", link, "current is not a symlink",
+			fmt.Sprintf("rm -rf %s && ln -s %s %s", link, cfg.GenesisDir(), link))
+		return
+	}
+
+	dest, err := os.Readlink(link)
+	if err != nil {
+		d.add(SeverityError, "current", link, err.Error(), "")
+		return
+	}
+	target, err := os.Stat(dest)
+	if err != nil || !target.IsDir() {
+		d.add(SeverityError, "current", link, fmt.Sprintf("current points to %s, which is not a directory", dest),
+			fmt.Sprintf("ln -sfn %s %s", cfg.GenesisDir(), link))
+		return
+	}
+	if dest != cfg.GenesisDir() && filepath.Dir(dest) != filepath.Join(cfg.Root(), upgradesDir) {
+		d.add(SeverityWarning, "current", link, fmt.Sprintf("current points to %s, outside of genesis and upgrades", dest),
+			"move that version under upgrades/ and relink current")
+	}
+	bin := filepath.Join(dest, "bin", cfg.Name)
+	if err := EnsureBinary(bin); err != nil {
+		d.add(SeverityError, "current", bin, "current version has no valid binary: "+err.Error(),
+			"install the binary or point current to a valid version")
+	}
+}
+
+// checkWritable flags files and directories other users on the host may modify.
+// Binaries below them are refused unless insecure permissions are allowed.
+func (d *diagnosis) checkWritable(cfg *Config, path string) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	if err := checkReplaceable(path); err != nil {
+		severity := SeverityError
+		if cfg.AllowInsecurePermissions {
+			severity = SeverityWarning
+		}
+		d.add(severity, "permissions", path, err.Error(),
+			fmt.Sprintf("chmod go-w %s and chown it to the daemon user", path))
+	}
+}
+
+// DoctorCmd checks the upgrade_manager layout and prints all findings, as a table or as json with -json.
+// It fails if any finding has error severity.
+func DoctorCmd(opts Options, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(commandPrefix+"doctor", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	asJSON := flags.Bool("json", false, "print findings as json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// we don't use GetConfigFromEnv as a missing upgrade_manager dir is a finding, not a failure
+	cfg, err := readConfig(opts)
+	if err != nil {
+		return err
+	}
+	if err := cfg.validateSettings(); err != nil {
+		return err
+	}
+	findings := Diagnose(cfg)
+
+	if *asJSON {
+		// always print a list, even if empty
+		if findings == nil {
+			findings = []Finding{}
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(findings); err != nil {
+			return err
+		}
+	} else if err := writeFindings(stdout, findings); err != nil {
+		return err
+	}
+
+	errs := 0
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			errs++
+		}
+	}
+	if errs > 0 {
+		return errors.Errorf("found %d error(s)", errs)
+	}
+	return nil
+}
+
+func writeFindings(w io.Writer, findings []Finding) error {
+	if len(findings) == 0 {
+		_, err := fmt.Fprintln(w, "No problems found")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEVERITY\tCHECK\tPATH\tMESSAGE\tFIX")
+	for _, f := range findings {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", f.Severity, f.Check, f.Path, f.Message, f.Fix)
+	}
+	return tw.Flush()
+}
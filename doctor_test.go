@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnose(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// break the layout a little more
+	require.NoError(t, os.Chmod(cfg.UpgradeBin("chain2"), 0777))
+	require.NoError(t, os.Mkdir(filepath.Join(cfg.Root(), upgradesDir, stagingPrefix+"123"), 0700))
+
+	findings := Diagnose(cfg)
+	found := map[string]Severity{}
+	for _, f := range findings {
+		found[f.Check+" "+f.Path] = f.Severity
+		assert.NotEmpty(t, f.Message)
+	}
+	upgrades := filepath.Join(cfg.Root(), upgradesDir)
+	expected := map[string]Severity{
+		"partial-download " + cfg.UpgradeBin("nobin"):                 SeverityError,
+		"upgrade " + cfg.UpgradeBin("noexec"):                         SeverityError,
+		"permissions " + cfg.UpgradeBin("chain2"):                     SeverityError,
+		"partial-download " + filepath.Join(upgrades, ".install-123"): SeverityWarning,
+		"current " + filepath.Join(cfg.Root(), currentLink):           SeverityInfo,
+	}
+	assert.Equal(t, expected, found)
+
+	// once linked to an upgrade, current is fine
+	require.NoError(t, cfg.SetCurrentUpgrade("chain3"))
+	for _, f := range Diagnose(cfg) {
+		assert.NotEqual(t, "current", f.Check)
+	}
+
+	// a missing root is reported as such
+	findings = Diagnose(&Config{Home: filepath.Join(home, "nope"), Name: "dummyd"})
+	require.Len(t, findings, 1)
+	assert.Equal(t, "layout", findings[0].Check)
+}
+
+func TestDoctorCmd(t *testing.T) {
+	home, err := copyTestData("download")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	os.Setenv("DAEMON_HOME", home)
+	os.Setenv("DAEMON_NAME", "autod")
+	defer os.Unsetenv("DAEMON_HOME")
+	defer os.Unsetenv("DAEMON_NAME")
+
+	// no upgrades dir and no current link are only informational
+	var out bytes.Buffer
+	require.NoError(t, RunCommand("doctor", nil, []string{"-json"}, &out))
+	var findings []Finding
+	require.NoError(t, json.Unmarshal(out.Bytes(), &findings))
+	require.Len(t, findings, 2)
+	for _, f := range findings {
+		assert.Equal(t, SeverityInfo, f.Severity)
+	}
+
+	// a missing genesis binary fails
+	require.NoError(t, os.Remove(filepath.Join(home, rootName, genesisDir, "bin", "autod")))
+	out.Reset()
+	require.Error(t, RunCommand("doctor", nil, nil, &out))
+	assert.Contains(t, out.String(), "binary is missing")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// What an upgrade would have done in dry-run mode
+const (
+	// DryRunSwitch means the binary is in place and current would be switched to it
+	DryRunSwitch = "switch"
+	// DryRunDownload means the binary would be downloaded before switching
+	DryRunDownload = "download"
+	// DryRunFail means the upgrade would fail, the reason is the error of the history record
+	DryRunFail = "fail"
+)
+
+// DryRunPlan is recorded in the history instead of performing an upgrade in dry-run mode
+type DryRunPlan struct {
+	Action string `json:"action"`
+	// Bin is the binary that would be selected, and Present whether it passes the checks
+	Bin         string `json:"bin"`
+	Present     bool   `json:"present"`
+	BinaryError string `json:"binary_error,omitempty"`
+	// URL is where the binary would be downloaded from, Checksum whether the url carries a checksum to verify it
+	URL      string `json:"url,omitempty"`
+	Checksum bool   `json:"checksum"`
+}
+
+// planUpgrade makes the same decisions as DoUpgrade without changing anything.
+// It returns the error the upgrade would fail with.
+func planUpgrade(cfg *Config, info *UpgradeInfo) (DryRunPlan, error) {
+	plan := DryRunPlan{Action: DryRunFail, Bin: cfg.UpgradeBin(info.Name)}
+	binErr := cfg.checkBinary(plan.Bin)
+	if binErr == nil {
+		plan.Present = true
+		if err := cfg.checkDiskSpace(0, "upgrade "+info.Name); err != nil {
+			return plan, err
+		}
+		plan.Action = DryRunSwitch
+		return plan, nil
+	}
+	plan.BinaryError = binErr.Error()
+
+	if !cfg.AllowDownloadBinaries {
+		return plan, errors.Wrap(binErr, "binary not present, downloading disabled")
+	}
+	if _, err := os.Stat(cfg.UpgradeDir(info.Name)); !os.IsNotExist(err) {
+		return plan, errors.Errorf("upgrade dir already exists, won't overwrite")
+	}
+	src, err := GetDownloadURL(info)
+	if err != nil {
+		return plan, errors.Wrap(err, "cannot download binary")
+	}
+	plan.URL = src
+	plan.Checksum = hasChecksum(src)
+	if err := cfg.checkDiskSpace(artifactSize(src, ""), "downloading "+info.Name); err != nil {
+		return plan, err
+	}
+	plan.Action = DryRunDownload
+	return plan, nil
+}
+
+// hasChecksum tells if go-getter verifies what it downloads from src
+func hasChecksum(src string) bool {
+	u, err := url.Parse(src)
+	return err == nil && u.Query().Get("checksum") != ""
+}
+
+// recordDryRun logs and records in the history what the upgrade to info would have done
+func (cfg *Config) recordDryRun(info *UpgradeInfo) {
+	start := time.Now()
+	plan, err := planUpgrade(cfg, info)
+	keyvals := []interface{}{"upgrade", info.Name, "height", info.Height, "time", info.Time, "action", plan.Action,
+		"bin", plan.Bin, "present", plan.Present, "url", plan.URL, "checksum", plan.Checksum}
+	if err != nil {
+		logger.Warn("dry run: upgrade detected, it would fail", append(keyvals, "error", err)...)
+	} else {
+		logger.Info("dry run: upgrade detected, not upgrading", keyvals...)
+	}
+	notifyStatus("dry run: upgrade " + info.Name + " detected, would " + plan.Action)
+	cfg.appendHistory(HistoryRecord{
+		Event:     EventDryRun,
+		Upgrade:   info,
+		NewTarget: cfg.UpgradeDir(info.Name),
+		Source:    plan.URL,
+		DryRun:    &plan,
+	}, start, err)
+}
+
+// dryRunBin is like CurrentBin, but falls back to the genesis binary without creating the current link
+func (cfg *Config) dryRunBin() string {
+	dir, err := cfg.CurrentDir()
+	if err != nil {
+		return cfg.GenesisBin()
+	}
+	return filepath.Join(dir, "bin", cfg.Name)
+}
+
+// ObserveUpgrades watches the output of the process like WaitForUpgradeOrExit, but never kills it.
+// observe is called once for every upgrade found in the output.
+// It returns when the process exited and its output was copied, with the error of the process.
+func ObserveUpgrades(cmd *exec.Cmd, output *daemonOutput, observe func(*UpgradeInfo)) error {
+	seen := map[string]bool{}
+	report := func() {
+		for _, upgrade := range output.take() {
+			if !seen[upgrade.Name] {
+				seen[upgrade.Name] = true
+				observe(upgrade)
+			}
+		}
+	}
+
+	exited := waitExit(cmd)
+	for {
+		select {
+		case <-output.found:
+			report()
+		case err := <-exited:
+			output.flush()
+			report()
+			return err
+		}
+	}
+}
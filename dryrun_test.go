@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLaunchProcessDryRun(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", DryRun: true}
+
+	// the daemon is never killed, and current is never touched
+	var stdout, stderr bytes.Buffer
+	doUpgrade, err := LaunchProcess(cfg, []string{"foo"}, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.False(t, doUpgrade)
+	assert.Equal(t, "Genesis foo\nUPGRADE \"chain2\" NEEDED at height: 49: {}\nNever should be printed!!!\n", stdout.String())
+	_, err = os.Lstat(filepath.Join(cfg.Root(), currentLink))
+	assert.True(t, os.IsNotExist(err))
+
+	records, err := cfg.ReadHistory()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	rec := records[0]
+	assert.Equal(t, EventDryRun, rec.Event)
+	assert.Equal(t, "chain2", rec.Upgrade.Name)
+	assert.Equal(t, OutcomeSuccess, rec.Outcome)
+	assert.Equal(t, &DryRunPlan{Action: DryRunSwitch, Bin: cfg.UpgradeBin("chain2"), Present: true}, rec.DryRun)
+}
+
+func TestLaunchProcessDryRunDownload(t *testing.T) {
+	home, err := copyTestData("download")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, DryRun: true}
+
+	var stdout, stderr bytes.Buffer
+	_, err = LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "Never should be printed!!!")
+	// nothing was downloaded
+	_, err = os.Stat(cfg.UpgradeDir("chain2"))
+	assert.True(t, os.IsNotExist(err))
+
+	records, err := cfg.ReadHistory()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	plan := records[0].DryRun
+	require.NotNil(t, plan)
+	assert.Equal(t, DryRunDownload, plan.Action)
+	assert.False(t, plan.Present)
+	assert.NotEmpty(t, plan.BinaryError)
+	assert.Contains(t, plan.URL, "zip_binary/autod.zip")
+	assert.True(t, plan.Checksum)
+	assert.Equal(t, plan.URL, records[0].Source)
+}
+
+func TestPlanUpgrade(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	plan, err := planUpgrade(cfg, &UpgradeInfo{Name: "noexec"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "downloading disabled")
+	assert.Equal(t, DryRunFail, plan.Action)
+
+	cfg.AllowDownloadBinaries = true
+	plan, err = planUpgrade(cfg, &UpgradeInfo{Name: "nobin"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "already exists")
+	assert.Equal(t, DryRunFail, plan.Action)
+
+	info := `{"binaries":{"` + osArch() + `":"https://example.com/gaia.zip"}}`
+	plan, err = planUpgrade(cfg, &UpgradeInfo{Name: "missing", Info: info})
+	require.NoError(t, err)
+	assert.Equal(t, DryRunDownload, plan.Action)
+	assert.Equal(t, "https://example.com/gaia.zip", plan.URL)
+	assert.False(t, plan.Checksum)
+}
@@ -6,6 +6,7 @@ require (
 	github.com/hashicorp/go-getter v1.4.0
 	github.com/homedepot/flop v0.1.4
 	github.com/pkg/errors v0.8.1
+	gopkg.in/yaml.v2 v2.2.2
 
 	// test dependencies
 	github.com/stretchr/testify v1.4.0
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Events recorded in the history
+const (
+	// EventDetected is an upgrade message found in the daemon output
+	EventDetected = "detected"
+	// EventDownload is an attempt to auto-download an upgrade binary
+	EventDownload = "download"
+	// EventSwitch is pointing current to an upgrade (after the binary was found or downloaded)
+	EventSwitch = "switch"
+	// EventRollback is pointing current back to the previous version
+	EventRollback = "rollback"
+	// EventDryRun is an upgrade detected in dry-run mode, with what would have been done
+	EventDryRun = "dry-run"
+	// EventApproval is waiting for an operator to approve an upgrade, it fails if the upgrade is rejected
+	EventApproval = "approval"
+	// EventStarted is the first start of the daemon after it was halted for an upgrade, the duration is the downtime
+	EventStarted = "started"
+)
+
+// Outcomes of a history event
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// HistoryRecord is one line of upgrade_manager/history.jsonl
+type HistoryRecord struct {
+	Time    time.Time    `json:"time"`
+	Event   string       `json:"event"`
+	Upgrade *UpgradeInfo `json:"upgrade,omitempty"`
+	// OldTarget and NewTarget are the version directories current pointed to before and after
+	OldTarget string `json:"old_target,omitempty"`
+	NewTarget string `json:"new_target,omitempty"`
+	// BinarySHA256 is the hash of the binary in NewTarget, once it is in place
+	BinarySHA256 string `json:"binary_sha256,omitempty"`
+	// Source is the url the binary was downloaded from, and Bytes the size of the download
+	Source     string `json:"source,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Outcome    string `json:"outcome"`
+	Error      string `json:"error,omitempty"`
+	// DryRun is what the upgrade would have done, for EventDryRun
+	DryRun *DryRunPlan `json:"dry_run,omitempty"`
+}
+
+// appendHistory fills in the time, duration and outcome of rec and appends it to the history.
+// Writing history is best effort, it must never block an upgrade.
+func (cfg *Config) appendHistory(rec HistoryRecord, start time.Time, err error) {
+	now := time.Now()
+	rec.Time = now.UTC()
+	rec.DurationMs = int64(now.Sub(start) / time.Millisecond)
+	rec.Outcome = OutcomeSuccess
+	if err != nil {
+		rec.Outcome = OutcomeFailure
+		rec.Error = err.Error()
+	}
+	if rec.NewTarget != "" && rec.BinarySHA256 == "" {
+		rec.BinarySHA256, _ = fileSHA256(filepath.Join(rec.NewTarget, "bin", cfg.Name))
+	}
+	if err := cfg.AppendHistory(rec); err != nil {
+		// the history is best effort, it must never fail what it records
+		logger.Warn("recording history failed", "event", rec.Event, "error", err)
+	}
+}
+
+// AppendHistory adds a record to upgrade_manager/history.jsonl, as a single write of one line
+// (so concurrent writers never interleave their records)
+func (cfg *Config) AppendHistory(rec HistoryRecord) error {
+	bz, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "encoding history record")
+	}
+	f, err := os.OpenFile(filepath.Join(cfg.Root(), historyFile), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Wrap(err, "opening history")
+	}
+	defer f.Close()
+	// a record cut short (eg. by a full disk) must not swallow this one
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			bz = append([]byte{'\n'}, bz...)
+		}
+	}
+	if _, err := f.Write(append(bz, '\n')); err != nil {
+		return errors.Wrap(err, "writing history")
+	}
+	return nil
+}
+
+// ReadHistory returns all history records, oldest first. Lines which aren't a record (eg. cut short by a crash)
+// are skipped with a warning.
+func (cfg *Config) ReadHistory() ([]HistoryRecord, error) {
+	f, err := os.Open(filepath.Join(cfg.Root(), historyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "opening history")
+	}
+	defer f.Close()
+
+	var records []HistoryRecord
+	// records have no size limit (errors may be long), so lines are read whole
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		bz, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, errors.Wrap(err, "reading history")
+		}
+		if trimmed := bytes.TrimSpace(bz); len(trimmed) > 0 {
+			var rec HistoryRecord
+			if jerr := json.Unmarshal(trimmed, &rec); jerr != nil {
+				logger.Warn("skipping invalid history line", "line", line, "error", jerr)
+			} else {
+				records = append(records, rec)
+			}
+		}
+		if err == io.EOF {
+			return records, nil
+		}
+	}
+}
+
+// LastUpgrade returns the most recent successful switch to an upgrade, or nil if there was none
+func (cfg *Config) LastUpgrade() (*HistoryRecord, error) {
+	records, err := cfg.ReadHistory()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Event == EventSwitch && records[i].Outcome == OutcomeSuccess {
+			return &records[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// HistoryCmd prints the upgrade history: `--cosmosd-history [-json] [-n N]`
+func HistoryCmd(opts Options, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(commandPrefix+"history", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	asJSON := flags.Bool("json", false, "print records as json lines")
+	last := flags.Int("n", 0, "only show the last n records")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := GetConfig(opts)
+	if err != nil {
+		return err
+	}
+	records, err := cfg.ReadHistory()
+	if err != nil {
+		return err
+	}
+	if *last > 0 && len(records) > *last {
+		records = records[len(records)-*last:]
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tUPGRADE\tOUTCOME\tDURATION\tTARGET\tERROR")
+	for _, rec := range records {
+		name := ""
+		if rec.Upgrade != nil {
+			name = rec.Upgrade.Name
+		}
+		duration := time.Duration(rec.DurationMs) * time.Millisecond
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", rec.Time.Format(time.RFC3339), rec.Event, name,
+			rec.Outcome, duration, rec.NewTarget, rec.Error)
+	}
+	return tw.Flush()
+}
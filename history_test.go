@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	records, err := cfg.ReadHistory()
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	// detect and perform the upgrade to chain2
+	var stdout, stderr bytes.Buffer
+	_, err = LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	// a failed upgrade and a rollback
+	require.Error(t, DoUpgrade(cfg, &UpgradeInfo{Name: "noexec"}))
+	_, err = cfg.Rollback()
+	require.NoError(t, err)
+
+	records, err = cfg.ReadHistory()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+
+	detected, switched, failed, rollback := records[0], records[1], records[2], records[3]
+	assert.Equal(t, EventDetected, detected.Event)
+	assert.Equal(t, &UpgradeInfo{Name: "chain2", Height: 49, Info: "{}"}, detected.Upgrade)
+
+	assert.Equal(t, EventSwitch, switched.Event)
+	assert.Equal(t, OutcomeSuccess, switched.Outcome)
+	assert.Equal(t, cfg.GenesisDir(), switched.OldTarget)
+	assert.Equal(t, cfg.UpgradeDir("chain2"), switched.NewTarget)
+	sha, err := fileSHA256(cfg.UpgradeBin("chain2"))
+	require.NoError(t, err)
+	assert.Equal(t, sha, switched.BinarySHA256)
+
+	assert.Equal(t, EventSwitch, failed.Event)
+	assert.Equal(t, OutcomeFailure, failed.Outcome)
+	assert.Contains(t, failed.Error, "downloading disabled")
+
+	assert.Equal(t, EventRollback, rollback.Event)
+	assert.Equal(t, OutcomeSuccess, rollback.Outcome)
+	assert.Equal(t, cfg.GenesisDir(), rollback.NewTarget)
+
+	// the failed upgrade doesn't count as the last one
+	last, err := cfg.LastUpgrade()
+	require.NoError(t, err)
+	assert.Equal(t, "chain2", last.Upgrade.Name)
+}
+
+func TestHistoryDamaged(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// a record cut short, and one longer than a bufio.Scanner accepts
+	require.NoError(t, cfg.AppendHistory(HistoryRecord{Event: EventDetected}))
+	path := filepath.Join(cfg.Root(), historyFile)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"event":"sw`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, cfg.AppendHistory(HistoryRecord{Event: EventSwitch, Error: strings.Repeat("x", 100000)}))
+	require.NoError(t, cfg.AppendHistory(HistoryRecord{Event: EventRollback}))
+
+	records, err := cfg.ReadHistory()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, EventDetected, records[0].Event)
+	assert.Equal(t, EventSwitch, records[1].Event)
+	assert.Len(t, records[1].Error, 100000)
+	assert.Equal(t, EventRollback, records[2].Event)
+}
+
+func TestHistoryCmd(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	os.Setenv("DAEMON_HOME", home)
+	os.Setenv("DAEMON_NAME", "dummyd")
+	defer os.Unsetenv("DAEMON_HOME")
+	defer os.Unsetenv("DAEMON_NAME")
+
+	cfg, err := GetConfigFromEnv()
+	require.NoError(t, err)
+	for _, name := range []string{"chain2", "chain3"} {
+		require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: name}))
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, RunCommand("history", nil, []string{"-json", "-n", "1"}, &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], `"name":"chain3"`)
+
+	out.Reset()
+	require.NoError(t, RunCommand("history", nil, nil, &out))
+	assert.Contains(t, out.String(), "chain2")
+	assert.Contains(t, out.String(), "chain3")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Manifest lists upgrades to pre-install when bootstrapping the layout.
+// Sources are anything InstallUpgrade accepts, relative paths are relative to the manifest file, eg.
+//
+//	{"upgrades": {"chain2": "https://example.com/gaia.zip?checksum=sha256:..."}}
+type Manifest struct {
+	Upgrades map[string]string `json:"upgrades"`
+}
+
+// ReadManifest parses a manifest file
+func ReadManifest(path string) (*Manifest, error) {
+	bz, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading manifest")
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(bz, &manifest); err != nil {
+		return nil, errors.Wrap(err, "parsing manifest")
+	}
+	return &manifest, nil
+}
+
+// InitLayout bootstraps the upgrade_manager directory from the genesis binary, archive or url src.
+// It creates genesis/bin/$DAEMON_NAME, the upgrades directory and the current link (unless it is already set).
+// A valid genesis binary is only replaced if force is set, and an existing genesis never while a cosmosd supervises
+// the directory.
+// It returns the output of the version probe.
+func InitLayout(cfg *Config, src string, force bool) (string, error) {
+	if err := cfg.validateSettings(); err != nil {
+		return "", err
+	}
+	if err := cfg.checkBinary(cfg.GenesisBin()); err == nil && !force {
+		return "", errors.Errorf("genesis is already installed at %s, use -force to replace it", cfg.GenesisBin())
+	}
+	if err := os.MkdirAll(cfg.Root(), 0755); err != nil {
+		return "", errors.Wrap(err, "creating upgrade_manager dir")
+	}
+	unlock, err := cfg.lockToReplace(cfg.GenesisDir())
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", errors.Wrap(err, "getting working directory")
+	}
+	version, err := cfg.installVersion(cfg.GenesisDir(), src, wd)
+	if err != nil {
+		return "", err
+	}
+
+	// leave current alone if it was already pointing somewhere (eg. re-installing genesis)
+	if _, err := cfg.CurrentDir(); err != nil {
+		if _, err := cfg.SymLinkToGenesis(); err != nil {
+			return "", errors.Wrap(err, "linking current to genesis")
+		}
+	}
+	return version, nil
+}
+
+// InstallManifest installs every upgrade listed in the manifest at path.
+// Upgrades that are already installed are skipped, unless force is set. Existing upgrade directories are never
+// replaced while a cosmosd supervises the directory. It returns the names of the installed upgrades.
+func InstallManifest(cfg *Config, path string, force bool) ([]string, error) {
+	manifest, err := ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	pwd := filepath.Dir(abs)
+
+	// install in a stable order, so failures are reproducible
+	names := make([]string, 0, len(manifest.Upgrades))
+	for name := range manifest.Upgrades {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var installed []string
+	for _, name := range names {
+		if err := cfg.checkBinary(cfg.UpgradeBin(name)); err == nil && !force {
+			continue
+		}
+		if err := cfg.installManifestUpgrade(name, manifest.Upgrades[name], pwd); err != nil {
+			return installed, errors.Wrapf(err, "installing upgrade %s", name)
+		}
+		installed = append(installed, name)
+	}
+	return installed, nil
+}
+
+func (cfg *Config) installManifestUpgrade(name, src, pwd string) error {
+	unlock, err := cfg.lockToReplace(cfg.UpgradeDir(name))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	_, err = cfg.installVersion(cfg.UpgradeDir(name), src, pwd)
+	return err
+}
+
+// InitCmd bootstraps the layout: `--cosmosd-init [-force] [-manifest <file>] <genesis file|archive|url>`
+func InitCmd(opts Options, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(commandPrefix+"init", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	force := flags.Bool("force", false, "replace the genesis binary (and upgrades in the manifest) if already installed")
+	manifest := flags.String("manifest", "", "json file listing upgrades to pre-install")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: --cosmosd-init [-force] [-manifest <file>] <genesis file|archive|url>")
+	}
+
+	// the layout doesn't exist yet, so we cannot use GetConfigFromEnv
+	cfg, err := readConfig(opts)
+	if err != nil {
+		return err
+	}
+	version, err := InitLayout(cfg, flags.Arg(0), *force)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Installed genesis at %s\n%s\n", cfg.GenesisBin(), version)
+
+	if *manifest == "" {
+		return nil
+	}
+	installed, err := InstallManifest(cfg, *manifest, *force)
+	for _, name := range installed {
+		fmt.Fprintf(stdout, "Installed upgrade %s at %s\n", name, cfg.UpgradeBin(name))
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitLayout(t *testing.T) {
+	home, err := ioutil.TempDir("", "upgrade-manager-init")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "autod"}
+
+	// layout doesn't exist yet
+	require.Error(t, cfg.validate())
+
+	src := filepath.Join("testdata", "repo", "raw_binary", "autod")
+	_, err = InitLayout(cfg, src, false)
+	require.NoError(t, err)
+
+	require.NoError(t, cfg.validate())
+	require.NoError(t, EnsureBinary(cfg.GenesisBin()))
+	assertCurrentLink(t, *cfg, genesisDir)
+	info, err := os.Stat(filepath.Join(cfg.Root(), upgradesDir))
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	// doctor is happy with the result
+	assert.Empty(t, Diagnose(cfg))
+
+	// no accidental overwrites
+	_, err = InitLayout(cfg, src, false)
+	require.Error(t, err)
+
+	// re-installing genesis keeps current where it is
+	require.NoError(t, os.MkdirAll(cfg.UpgradeDir("other"), 0755))
+	require.NoError(t, cfg.switchCurrent(cfg.UpgradeDir("other")))
+	_, err = InitLayout(cfg, src, true)
+	require.NoError(t, err)
+	dir, err := cfg.CurrentDir()
+	require.NoError(t, err)
+	assert.Equal(t, cfg.UpgradeDir("other"), dir)
+}
+
+func TestInitCmdWithManifest(t *testing.T) {
+	home, err := ioutil.TempDir("", "upgrade-manager-init")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	os.Setenv("DAEMON_HOME", home)
+	os.Setenv("DAEMON_NAME", "autod")
+	defer os.Unsetenv("DAEMON_HOME")
+	defer os.Unsetenv("DAEMON_NAME")
+
+	// relative paths in the manifest are relative to the manifest itself
+	zipped, err := filepath.Abs(filepath.Join("testdata", "repo", "zip_directory", "autod.zip"))
+	require.NoError(t, err)
+	bin, err := ioutil.ReadFile(filepath.Join("testdata", "repo", "raw_binary", "autod"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, "autod"), bin, 0755))
+	manifest := filepath.Join(home, "manifest.json")
+	require.NoError(t, ioutil.WriteFile(manifest, []byte(`{"upgrades": {"chain2": "./autod", "chain 3": "`+zipped+`"}}`), 0644))
+
+	var out bytes.Buffer
+	args := []string{"-manifest", manifest, filepath.Join("testdata", "repo", "zip_binary", "autod.zip")}
+	require.NoError(t, RunCommand("init", nil, args, &out))
+	assert.Contains(t, out.String(), "Installed upgrade chain2")
+	assert.Contains(t, out.String(), "Installed upgrade chain 3")
+
+	cfg, err := GetConfigFromEnv()
+	require.NoError(t, err)
+	for _, name := range []string{"chain2", "chain 3"} {
+		assert.NoError(t, EnsureBinary(cfg.UpgradeBin(name)), name)
+	}
+
+	// a broken manifest is reported
+	require.NoError(t, ioutil.WriteFile(manifest, []byte(`{"upgrades": {"chain4": "./missing"}}`), 0644))
+	_, err = InstallManifest(cfg, manifest, false)
+	require.Error(t, err)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/pkg/errors"
+)
+
+// stagingPrefix is used for temporary directories under upgrades/ while a version is being installed.
+// A leftover directory with this prefix is a partial install and can be removed.
+const stagingPrefix = ".install-"
+
+// versionProbeTimeout is how long we wait for `$DAEMON_NAME version` on a freshly installed binary
+const versionProbeTimeout = 10 * time.Second
+
+// InstallUpgrade places the binary, archive or url src under upgrades/<name> so it is picked up
+// when the named upgrade is needed. A valid existing upgrade is only replaced if force is set, and
+// never while a cosmosd supervises the directory. Relative paths are resolved against the working directory.
+// It returns the output of the version probe.
+func InstallUpgrade(cfg *Config, name, src string, force bool) (string, error) {
+	if name == "" {
+		return "", errors.New("upgrade name is required")
+	}
+	dest := cfg.UpgradeDir(name)
+	if err := cfg.checkBinary(cfg.UpgradeBin(name)); err == nil && !force {
+		return "", errors.Errorf("upgrade %s is already installed at %s, use -force to replace it", name, dest)
+	}
+	unlock, err := cfg.lockToReplace(dest)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", errors.Wrap(err, "getting working directory")
+	}
+	return cfg.installVersion(dest, src, wd)
+}
+
+// lockToReplace takes the lock if the version directory dir exists, as a cosmosd supervising the directory
+// may be using it. The returned function releases the lock (if any).
+func (cfg *Config) lockToReplace(dir string) (func(), error) {
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return func() {}, nil
+	}
+	lock, err := cfg.Lock()
+	if err != nil {
+		return nil, err
+	}
+	return func() { _ = lock.Unlock() }, nil
+}
+
+// installVersion fetches src into the version directory dest, replacing whatever is there (unless it is
+// the current version and the daemon is running). It fails if src doesn't fit on the disk. The version is
+// staged under upgrades/ and validated (EnsureBinary and a version probe) before it is moved into place.
+// Relative paths in src are resolved against pwd. It returns the output of the version probe.
+func (cfg *Config) installVersion(dest, src, pwd string) (string, error) {
+	if cfg.isCurrent(dest) {
+		if pid, ok := cfg.RunningDaemon(); ok {
+			return "", errors.Errorf("%s is the current version and the daemon is running (pid %d), stop it before replacing it",
+				dest, pid)
+		}
+	}
+	upgrades := filepath.Join(cfg.Root(), upgradesDir)
+	if err := os.MkdirAll(upgrades, 0755); err != nil {
+		return "", errors.Wrap(err, "creating upgrades dir")
+	}
+	if err := cfg.checkDiskSpace(artifactSize(src, pwd), "installing "+versionName(cfg, dest)); err != nil {
+		return "", err
+	}
+	staging, err := ioutil.TempDir(upgrades, stagingPrefix)
+	if err != nil {
+		return "", errors.Wrap(err, "creating staging dir")
+	}
+	// after a successful install this is already renamed, so this is only cleanup on failure
+	defer os.RemoveAll(staging)
+
+	version, err := stageVersion(staging, cfg.Name, src, pwd)
+	if err != nil {
+		return "", err
+	}
+
+	// TempDir creates 0700, but the version dir should be readable like the rest of the layout
+	if err := os.Chmod(staging, 0755); err != nil {
+		return "", errors.Wrap(err, "setting version dir permissions")
+	}
+	// move the old version aside rather than removing it first, so dest is never left half deleted
+	old := staging + "-old"
+	if err := os.Rename(dest, old); err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "moving previous version dir aside")
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		if rerr := os.Rename(old, dest); rerr != nil && !os.IsNotExist(rerr) {
+			logger.Error("restoring previous version dir failed", "dir", dest, "from", old, "error", rerr)
+		}
+		return "", errors.Wrap(err, "moving version into place")
+	}
+	// a leftover is a partial install, which the doctor reports
+	if err := os.RemoveAll(old); err != nil {
+		logger.Warn("removing previous version dir failed", "dir", old, "error", err)
+	}
+	return version, nil
+}
+
+// isCurrent tells if dir is the version directory current points to
+func (cfg *Config) isCurrent(dir string) bool {
+	cur, err := os.Stat(filepath.Join(cfg.Root(), currentLink))
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(dir)
+	return err == nil && os.SameFile(cur, info)
+}
+
+// stageVersion fetches src into the (empty) version directory dir and validates the binary.
+// It returns the output of the version probe.
+func stageVersion(dir, name, src, pwd string) (string, error) {
+	if err := fetchVersion(dir, name, src, withPwd(pwd)); err != nil {
+		return "", errors.Wrapf(err, "fetching %s", src)
+	}
+	bin := filepath.Join(dir, "bin", name)
+	if err := EnsureBinary(bin); err != nil {
+		return "", errors.Wrap(err, "installed binary invalid")
+	}
+	return ProbeVersion(bin)
+}
+
+// withPwd lets go-getter resolve relative paths against pwd
+func withPwd(pwd string) getter.ClientOption {
+	return func(c *getter.Client) error {
+		c.Pwd = pwd
+		return nil
+	}
+}
+
+// ProbeVersion runs `bin version` to make sure the binary actually runs on this host,
+// returning its (trimmed) output
+func ProbeVersion(bin string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), versionProbeTimeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, "version")
+	cmd.Env = VersionLibraryPath(VersionDir(bin), os.Environ())
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "running %s version: %s", bin, strings.TrimSpace(out.String()))
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// InstallCmd installs an upgrade binary: `--cosmosd-install [-force] <upgrade-name> <file|archive|url>`
+func InstallCmd(opts Options, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(commandPrefix+"install", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	force := flags.Bool("force", false, "replace the upgrade even if a valid binary is already installed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("usage: --cosmosd-install [-force] <upgrade-name> <file|archive|url>")
+	}
+
+	cfg, err := GetConfig(opts)
+	if err != nil {
+		return err
+	}
+	name, src := flags.Arg(0), flags.Arg(1)
+	version, err := InstallUpgrade(cfg, name, src, *force)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Installed upgrade %s at %s\n%s\n", name, cfg.UpgradeBin(name), version)
+	return nil
+}
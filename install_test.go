@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstallUpgrade(t *testing.T) {
+	cases := map[string]struct {
+		src         string
+		name        string
+		isErr       bool
+		expectProbe string
+	}{
+		"raw binary": {
+			src:         "./testdata/repo/raw_binary/autod",
+			name:        "chain2",
+			expectProbe: "Chain 2 is live!\nArgs: version\nFinished successfully",
+		},
+		"zipped binary": {
+			src:  "./testdata/repo/zip_binary/autod.zip",
+			name: "with spaces/and slash",
+		},
+		"zipped directory with checksum": {
+			src:  "./testdata/repo/zip_directory/autod.zip?checksum=sha256:3784e4574cad69b67e34d4ea4425eff140063a3870270a301d6bb24a098a27ae",
+			name: "chain3",
+		},
+		"invalid checksum": {
+			src:   "./testdata/repo/zip_directory/autod.zip?checksum=sha256:73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906",
+			name:  "chain3",
+			isErr: true,
+		},
+		"not executable": {
+			src:   "./testdata/repo/ref_zipped",
+			name:  "chain3",
+			isErr: true,
+		},
+		"missing file": {
+			src:   "./testdata/repo/no/such/file",
+			name:  "chain3",
+			isErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("download")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			cfg := &Config{Home: home, Name: "autod"}
+
+			probe, err := InstallUpgrade(cfg, tc.name, tc.src, false)
+			if tc.isErr {
+				require.Error(t, err)
+				_, err = os.Stat(cfg.UpgradeDir(tc.name))
+				assert.True(t, os.IsNotExist(err))
+			} else {
+				require.NoError(t, err)
+				require.NoError(t, EnsureBinary(cfg.UpgradeBin(tc.name)))
+				if tc.expectProbe != "" {
+					assert.Equal(t, tc.expectProbe, probe)
+				}
+			}
+
+			// never leave partial installs behind
+			entries, err := ioutil.ReadDir(filepath.Join(cfg.Root(), upgradesDir))
+			require.NoError(t, err)
+			for _, e := range entries {
+				assert.NotContains(t, e.Name(), stagingPrefix)
+			}
+		})
+	}
+}
+
+func TestInstallUpgradeOverwrite(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	src := filepath.Join("testdata", "repo", "raw_binary", "autod")
+
+	// a valid upgrade is left alone unless forced
+	_, err = InstallUpgrade(cfg, "chain3", src, false)
+	require.Error(t, err)
+	_, err = InstallUpgrade(cfg, "chain3", src, true)
+	require.NoError(t, err)
+
+	// an invalid one can be replaced
+	_, err = InstallUpgrade(cfg, "noexec", src, false)
+	require.NoError(t, err)
+	assert.NoError(t, EnsureBinary(cfg.UpgradeBin("noexec")))
+	// the old versions were moved aside and removed, nothing is left behind
+	leftovers, err := filepath.Glob(filepath.Join(cfg.Root(), upgradesDir, stagingPrefix+"*"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+
+	// the version the daemon is running is not replaced under its feet
+	require.NoError(t, cfg.SetCurrentUpgrade("chain3"))
+	require.NoError(t, cfg.writeDaemonPid(os.Getpid()))
+	_, err = InstallUpgrade(cfg, "chain3", src, true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "daemon is running")
+	_, err = InstallUpgrade(cfg, "chain2", src, true)
+	require.NoError(t, err)
+	cfg.removeDaemonPid()
+	_, err = InstallUpgrade(cfg, "chain3", src, true)
+	require.NoError(t, err)
+	assertCurrentLink(t, *cfg, filepath.Join(upgradesDir, "chain3"))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// keys of an instance in the instances file which are not settings
+const (
+	instanceIDKey   = "id"
+	instanceArgsKey = "args"
+)
+
+// secretSettings are passed to the cosmosd of an instance in its environment, as its command line is
+// visible to every user
+var secretSettings = map[string]bool{"webhook_secret": true}
+
+// Instance is one daemon supervised in multi-daemon mode, see Supervise
+type Instance struct {
+	ID string
+	// Options are the settings of the instance, its cosmosd gets them as --cosmosd.<key>=<value>
+	// (or as environmental variables, see secretSettings)
+	Options Options
+	// Args are passed to the daemon
+	Args   []string
+	Config *Config
+}
+
+// instancesFile is the format of the file listing all instances. Instances take their settings from
+// defaults, unless they set them themselves.
+type instancesFile struct {
+	Defaults  map[string]interface{}   `yaml:"defaults"`
+	Instances []map[string]interface{} `yaml:"instances"`
+}
+
+// LoadInstances reads the instances file at path. opts (from the command line) take precedence over the
+// settings in the file, which take precedence over the config file in the home of each instance.
+func LoadInstances(path string, opts Options) ([]*Instance, error) {
+	bz, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading instances file")
+	}
+	var file instancesFile
+	if err := yaml.UnmarshalStrict(bz, &file); err != nil {
+		return nil, errors.Wrapf(err, "parsing instances file %s", path)
+	}
+	if len(file.Instances) == 0 {
+		return nil, errors.Errorf("no instances in %s", path)
+	}
+	defaults, err := settingValues(file.Defaults, "defaults of "+path)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]*Instance, 0, len(file.Instances))
+	ids, roots := map[string]bool{}, map[string]string{}
+	for i, raw := range file.Instances {
+		source := fmt.Sprintf("instance %d of %s", i+1, path)
+		inst, err := parseInstance(raw, defaults, opts, source)
+		if err != nil {
+			return nil, err
+		}
+		if ids[inst.ID] {
+			return nil, errors.Errorf("duplicate instance id %q in %s", inst.ID, path)
+		}
+		ids[inst.ID] = true
+		// two upgrade managers can't share a home, see Lock
+		if other, ok := roots[inst.Config.Root()]; ok {
+			return nil, errors.Errorf("instances %s and %s have the same home %s", other, inst.ID, inst.Config.Home)
+		}
+		roots[inst.Config.Root()] = inst.ID
+		instances = append(instances, inst)
+	}
+	return instances, nil
+}
+
+func parseInstance(raw map[string]interface{}, defaults map[string]string, opts Options, source string) (*Instance, error) {
+	inst := &Instance{Options: Options{}}
+	if id, ok := raw[instanceIDKey]; ok {
+		str, ok := id.(string)
+		if !ok {
+			return nil, errors.Errorf("id in %s must be a string", source)
+		}
+		inst.ID = str
+		delete(raw, instanceIDKey)
+	}
+	if args, ok := raw[instanceArgsKey]; ok {
+		list, ok := args.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("args in %s must be a list", source)
+		}
+		for _, arg := range list {
+			str, err := settingValue(arg)
+			if err != nil {
+				return nil, errors.Wrapf(err, "args in %s", source)
+			}
+			inst.Args = append(inst.Args, str)
+		}
+		delete(raw, instanceArgsKey)
+	}
+	values, err := settingValues(raw, source)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, layer := range []map[string]string{defaults, values, opts} {
+		for key, value := range layer {
+			if key != configOption {
+				inst.Options[key] = value
+			}
+		}
+	}
+	inst.Config, err = instanceConfig(inst.Options, source)
+	if err != nil {
+		return nil, err
+	}
+	if inst.ID == "" {
+		inst.ID = inst.Config.Name
+	}
+	return inst, nil
+}
+
+// instanceConfig is the config the cosmosd of an instance ends up with: its options on top of the
+// config file in its home (the environment of the supervisor is not passed on)
+func instanceConfig(opts Options, source string) (*Config, error) {
+	cfg := &Config{}
+	if home := opts["home"]; home != "" {
+		path := filepath.Join(home, rootName, configFile)
+		file, err := readConfigFile(path)
+		if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return nil, err
+		}
+		if err := applySettings(cfg, file, path); err != nil {
+			return nil, err
+		}
+	}
+	if err := applySettings(cfg, opts, source); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, errors.Wrap(err, source)
+	}
+	return cfg, nil
+}
+
+// commandArgs are the arguments of the cosmosd running the instance
+func (inst *Instance) commandArgs() []string {
+	keys := make([]string, 0, len(inst.Options))
+	for key := range inst.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := make([]string, 0, len(keys)+len(inst.Args))
+	for _, key := range keys {
+		if !secretSettings[key] {
+			args = append(args, optionPrefix+key+"="+inst.Options[key])
+		}
+	}
+	return append(args, inst.Args...)
+}
+
+// commandEnv holds the secret settings of the instance, as environmental variables of its cosmosd
+func (inst *Instance) commandEnv() []string {
+	var env []string
+	for _, s := range settings {
+		if value, ok := inst.Options[s.key]; ok && secretSettings[s.key] {
+			env = append(env, s.env+"="+value)
+		}
+	}
+	return env
+}
+
+// InstanceStatus is a read-only snapshot of one instance
+type InstanceStatus struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Home    string `json:"home"`
+	Running bool   `json:"running"`
+	Pid     int    `json:"pid,omitempty"`
+	// Current is the version current points to (genesis or the upgrade name), empty if not linked yet
+	Current     string         `json:"current"`
+	LastUpgrade *HistoryRecord `json:"last_upgrade"`
+	Error       string         `json:"error,omitempty"`
+}
+
+// Status inspects the instance without modifying it
+func (inst *Instance) Status() InstanceStatus {
+	cfg := inst.Config
+	status := InstanceStatus{ID: inst.ID, Name: cfg.Name, Home: cfg.Home}
+	status.Pid, status.Running = cfg.RunningDaemon()
+	if !status.Running {
+		status.Pid = 0
+	}
+	if dir, err := cfg.CurrentDir(); err == nil {
+		status.Current = versionName(cfg, dir)
+	}
+	last, err := cfg.LastUpgrade()
+	if err != nil {
+		status.Error = err.Error()
+	}
+	status.LastUpgrade = last
+	return status
+}
+
+// InstancesCmd prints the status of every instance in an instances file:
+// `--cosmosd-instances [-json] <instances-file>`
+func InstancesCmd(opts Options, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(commandPrefix+"instances", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	asJSON := flags.Bool("json", false, "print status as json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: --cosmosd-instances [-json] <instances-file>")
+	}
+
+	instances, err := LoadInstances(flags.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	statuses := make([]InstanceStatus, len(instances))
+	for i, inst := range instances {
+		statuses[i] = inst.Status()
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tRUNNING\tPID\tCURRENT\tLAST UPGRADE\tHOME")
+	for _, s := range statuses {
+		pid, current, last := "", s.Current, ""
+		if s.Pid != 0 {
+			pid = strconv.Itoa(s.Pid)
+		}
+		if current == "" {
+			current = "(not linked)"
+		}
+		if s.LastUpgrade != nil {
+			last = s.LastUpgrade.Upgrade.Name
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\t%s\t%s\n", s.ID, s.Name, s.Running, pid, current, last, s.Home)
+	}
+	return tw.Flush()
+}
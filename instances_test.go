@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeInstances creates an instances file with two instances of the validate testdata
+func writeInstances(t *testing.T, extra string) (string, []string) {
+	var homes []string
+	for i := 0; i < 2; i++ {
+		home, err := copyTestData("validate")
+		require.NoError(t, err)
+		homes = append(homes, home)
+	}
+	content := fmt.Sprintf(`defaults:
+  name: dummyd
+  restart_after_upgrade: true
+instances:
+  - id: first
+    home: %s
+    args: [foo, 1]
+  - home: %s
+    retain_upgrades: 2
+%s`, homes[0], homes[1], extra)
+	path := filepath.Join(homes[0], "instances.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path, homes
+}
+
+func TestLoadInstances(t *testing.T) {
+	path, homes := writeInstances(t, "")
+	for _, home := range homes {
+		defer os.RemoveAll(home)
+	}
+	// the config file of the home comes last
+	require.NoError(t, ioutil.WriteFile(filepath.Join(homes[1], rootName, configFile),
+		[]byte("retain_upgrades: 5\nallow_download_binaries: true\n"), 0644))
+
+	instances, err := LoadInstances(path, Options{"restart_after_upgrade": "false", "webhook_secret": "s3cret",
+		configOption: "/etc/cosmosd.yaml"})
+	require.NoError(t, err)
+	require.Len(t, instances, 2)
+
+	first := instances[0]
+	assert.Equal(t, "first", first.ID)
+	assert.Equal(t, []string{"foo", "1"}, first.Args)
+	assert.Equal(t, &Config{Home: homes[0], Name: "dummyd", WebhookSecret: "s3cret"}, first.Config)
+	assert.Equal(t, []string{
+		"--cosmosd.home=" + homes[0],
+		"--cosmosd.name=dummyd",
+		"--cosmosd.restart_after_upgrade=false",
+		"foo", "1",
+	}, first.commandArgs())
+	// secrets stay off the command line
+	assert.Equal(t, []string{"DAEMON_WEBHOOK_SECRET=s3cret"}, first.commandEnv())
+
+	second := instances[1]
+	assert.Equal(t, "dummyd", second.ID)
+	assert.Empty(t, second.Args)
+	assert.Equal(t, &Config{Home: homes[1], Name: "dummyd", RetainUpgrades: 2, AllowDownloadBinaries: true,
+		WebhookSecret: "s3cret"}, second.Config)
+}
+
+func TestLoadInstancesErrors(t *testing.T) {
+	cases := map[string]string{
+		"duplicate instance id": "  - id: first\n    home: HOME\n",
+		"same home":             "  - id: third\n    home: HOME\n",
+		"unknown key":           "  - id: third\n    home: /tmp\n    no_such_setting: 1\n",
+		"cannot stat home dir":  "  - id: third\n    home: /no/such/home\n",
+		"must be a list":        "  - id: third\n    home: /tmp\n    args: start\n",
+	}
+	for msg, extra := range cases {
+		t.Run(msg, func(t *testing.T) {
+			path, homes := writeInstances(t, "")
+			for _, home := range homes {
+				defer os.RemoveAll(home)
+			}
+			bz, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			extra = string(bytes.Replace([]byte(extra), []byte("HOME"), []byte(homes[1]), 1))
+			require.NoError(t, ioutil.WriteFile(path, append(bz, extra...), 0644))
+
+			_, err = LoadInstances(path, nil)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), msg)
+		})
+	}
+
+	empty := filepath.Join(os.TempDir(), "no-instances.yaml")
+	require.NoError(t, ioutil.WriteFile(empty, []byte("defaults:\n  name: gaiad\n"), 0644))
+	defer os.Remove(empty)
+	_, err := LoadInstances(empty, nil)
+	assert.Error(t, err)
+}
+
+func TestInstancesCmd(t *testing.T) {
+	path, homes := writeInstances(t, "")
+	for _, home := range homes {
+		defer os.RemoveAll(home)
+	}
+	instances, err := LoadInstances(path, nil)
+	require.NoError(t, err)
+	require.NoError(t, DoUpgrade(instances[1].Config, &UpgradeInfo{Name: "chain2"}))
+	// pretend we are the daemon of the first instance
+	require.NoError(t, instances[0].Config.writeDaemonPid(os.Getpid()))
+
+	var out bytes.Buffer
+	require.NoError(t, RunCommand("instances", nil, []string{"-json", path}, &out))
+	var statuses []InstanceStatus
+	require.NoError(t, json.Unmarshal(out.Bytes(), &statuses))
+	require.Len(t, statuses, 2)
+	assert.Equal(t, "first", statuses[0].ID)
+	assert.True(t, statuses[0].Running)
+	assert.Equal(t, os.Getpid(), statuses[0].Pid)
+	assert.Equal(t, "", statuses[0].Current)
+	assert.Nil(t, statuses[0].LastUpgrade)
+	assert.False(t, statuses[1].Running)
+	assert.Equal(t, "chain2", statuses[1].Current)
+	require.NotNil(t, statuses[1].LastUpgrade)
+	assert.Equal(t, "chain2", statuses[1].LastUpgrade.Upgrade.Name)
+
+	out.Reset()
+	require.NoError(t, RunCommand("instances", nil, []string{path}, &out))
+	assert.Contains(t, out.String(), "(not linked)")
+	assert.Contains(t, out.String(), homes[1])
+
+	require.Error(t, RunCommand("instances", nil, nil, &out))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Lock is the exclusive lock of an upgrade manager on its upgrade_manager directory.
+// It is an advisory flock, so the kernel releases it when the process dies, however it dies.
+type Lock struct {
+	file *os.File
+}
+
+// ErrLocked is returned by Lock when another upgrade manager supervises the same directory
+type ErrLocked struct {
+	Path string
+	// Pid is the holder recorded in the lock file, 0 if unknown
+	Pid int
+	// Stale is set if the recorded holder is gone, yet some other process still holds the lock
+	// (eg. a process it started inherited the file)
+	Stale bool
+}
+
+func (e *ErrLocked) Error() string {
+	switch {
+	case e.Pid == 0:
+		return fmt.Sprintf("another cosmosd is already running for this directory (%s is locked)", e.Path)
+	case e.Stale:
+		return fmt.Sprintf("%s is locked, but its holder (pid %d) is no longer running; find the process holding it with `fuser %s`", e.Path, e.Pid, e.Path)
+	default:
+		return fmt.Sprintf("another cosmosd (pid %d) is already running for this directory (%s is locked)", e.Pid, e.Path)
+	}
+}
+
+// Lock makes sure we are the only upgrade manager supervising this directory, as two of them would race
+// on the current link and could start two validators. The pid of the holder is recorded in the lock file.
+func (cfg *Config) Lock() (*Lock, error) {
+	path := filepath.Join(cfg.Root(), lockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening lock file")
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		pid := readLockPid(f)
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, &ErrLocked{Path: path, Pid: pid, Stale: pid != 0 && !processAlive(pid)}
+		}
+		return nil, errors.Wrap(err, "locking")
+	}
+
+	// the lock was free, so whoever is recorded in the file is gone
+	if pid := readLockPid(f); pid != 0 {
+		logger.Warn("taking over stale lock", "path", path, "pid", pid)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "writing lock file")
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "writing lock file")
+	}
+	return &Lock{file: f}, nil
+}
+
+// Unlock releases the lock. The file itself stays, as removing it would let two processes
+// lock different files.
+func (l *Lock) Unlock() error {
+	defer l.file.Close()
+	if err := l.file.Truncate(0); err != nil {
+		return errors.Wrap(err, "clearing lock file")
+	}
+	return errors.Wrap(syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN), "unlocking")
+}
+
+func readLockPid(f *os.File) int {
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0
+	}
+	bz, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bz)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	return pid
+}
+
+// processAlive checks the process exists. Signal 0 only checks, and EPERM means it exists but isn't ours.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// processStartTime identifies when the process was started, as the boot id and the start time since boot
+// (from /proc, so it is only available on linux)
+func processStartTime(pid int) (string, bool) {
+	boot, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", false
+	}
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", false
+	}
+	// the command name may contain spaces and parentheses, the fields after it start with the state (field 3)
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return "", false
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return "", false
+	}
+	return strings.TrimSpace(string(boot)) + "/" + fields[19], true
+}
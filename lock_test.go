@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deadPid returns the pid of a process that already exited
+func deadPid(t *testing.T) int {
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	return cmd.Process.Pid
+}
+
+func TestLock(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	path := filepath.Join(cfg.Root(), lockFile)
+
+	lock, err := cfg.Lock()
+	require.NoError(t, err)
+	bz, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid())+"\n", string(bz))
+
+	// a second manager is refused
+	_, err = cfg.Lock()
+	require.Error(t, err)
+	locked, ok := err.(*ErrLocked)
+	require.True(t, ok)
+	assert.Equal(t, os.Getpid(), locked.Pid)
+	assert.False(t, locked.Stale)
+	assert.Contains(t, err.Error(), "another cosmosd (pid "+strconv.Itoa(os.Getpid())+") is already running")
+
+	require.NoError(t, lock.Unlock())
+	lock, err = cfg.Lock()
+	require.NoError(t, err)
+	require.NoError(t, lock.Unlock())
+}
+
+func TestStaleLock(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	path := filepath.Join(cfg.Root(), lockFile)
+	dead := strconv.Itoa(deadPid(t))
+
+	// a manager died without cleaning up, the kernel released its lock
+	require.NoError(t, ioutil.WriteFile(path, []byte(dead+"\n"), 0644))
+	var logs bytes.Buffer
+	defer func(l *Logger) { logger = l }(logger)
+	logger = NewLogger(&logs, LevelInfo, LogFormatLogfmt, "")
+	lock, err := cfg.Lock()
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), "taking over stale lock")
+	assert.Contains(t, logs.String(), "pid="+dead)
+	require.NoError(t, lock.Unlock())
+
+	// the lock is still held by some other process, eg. one the dead manager started
+	require.NoError(t, ioutil.WriteFile(path, []byte(dead+"\n"), 0644))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, syscall.Flock(int(f.Fd()), syscall.LOCK_EX))
+	_, err = cfg.Lock()
+	require.Error(t, err)
+	locked, ok := err.(*ErrLocked)
+	require.True(t, ok)
+	assert.True(t, locked.Stale)
+	assert.Contains(t, err.Error(), "no longer running")
+}
+
+func TestCommandsRefuseWhileLocked(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	opts := Options{"home": home, "name": "dummyd"}
+	bin := filepath.Join(cfg.UpgradeDir("chain2"), "bin", "dummyd")
+
+	// a cosmosd supervises the directory
+	lock, err := cfg.Lock()
+	require.NoError(t, err)
+	// a broken install is replaced even without -force
+	require.NoError(t, os.MkdirAll(cfg.UpgradeDir("broken"), 0755))
+	var out bytes.Buffer
+	for _, args := range [][]string{
+		{"rollback"},
+		{"prune"},
+		{"install", "-force", "chain2", bin},
+		{"install", "broken", bin},
+		{"init", "-force", cfg.GenesisBin()},
+	} {
+		err := RunCommand(args[0], opts, args[1:], &out)
+		require.Error(t, err, args[0])
+		_, ok := errors.Cause(err).(*ErrLocked)
+		assert.True(t, ok, "%s: %v", args[0], err)
+	}
+	// only looking, or installing a new upgrade, is fine
+	require.NoError(t, RunCommand("prune", opts, []string{"-dry-run"}, &out))
+	require.NoError(t, RunCommand("install", opts, []string{"fresh", bin}, &out))
+	require.NoError(t, lock.Unlock())
+}
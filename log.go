@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// log levels, in increasing order of severity
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+const (
+	// LogFormatLogfmt writes events as key=value pairs
+	LogFormatLogfmt = "logfmt"
+	// LogFormatJSON writes events as one json object per line
+	LogFormatJSON = "json"
+
+	// LogOutputStderr writes events to stderr, prefixed with logPrefix so they stand out from the daemon logs
+	LogOutputStderr = "stderr"
+	// LogOutputSyslog sends events to the local syslog daemon
+	LogOutputSyslog = "syslog"
+
+	logPrefix = "[cosmosd] "
+)
+
+// Logger writes the events of the upgrade manager itself, never the output of the daemon.
+// It is safe for concurrent use.
+type Logger struct {
+	level  int
+	format string
+	prefix string
+	mutex  sync.Mutex
+	out    io.Writer
+}
+
+// logger is used for all events of the upgrade manager, Run replaces it according to the config
+var logger = NewLogger(os.Stderr, LevelInfo, LogFormatLogfmt, logPrefix)
+
+// NewLogger writes events of at least level to out, each line starting with prefix
+func NewLogger(out io.Writer, level int, format, prefix string) *Logger {
+	return &Logger{out: out, level: level, format: format, prefix: prefix}
+}
+
+// OpenLogger creates the logger configured in cfg (level, format and output, which is stderr, syslog or a file path)
+func OpenLogger(cfg *Config) (*Logger, error) {
+	level, err := parseLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	format := cfg.LogFormat
+	switch format {
+	case "":
+		format = LogFormatLogfmt
+	case LogFormatLogfmt, LogFormatJSON:
+	default:
+		return nil, errors.Errorf("unknown log format %q (logfmt or json)", format)
+	}
+
+	switch cfg.LogOutput {
+	case "", LogOutputStderr:
+		return NewLogger(os.Stderr, level, format, logPrefix), nil
+	case LogOutputSyslog:
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "cosmosd")
+		if err != nil {
+			return nil, errors.Wrap(err, "connecting to syslog")
+		}
+		return NewLogger(w, level, format, ""), nil
+	default:
+		f, err := os.OpenFile(cfg.LogOutput, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "opening log file")
+		}
+		return NewLogger(f, level, format, ""), nil
+	}
+}
+
+func parseLevel(name string) (int, error) {
+	if name == "" {
+		return LevelInfo, nil
+	}
+	for level, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return level, nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level %q (debug, info, warn or error)", name)
+}
+
+// Debug logs msg with the key value pairs in keyvals
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+
+// Info logs msg with the key value pairs in keyvals
+func (l *Logger) Info(msg string, keyvals ...interface{}) { l.log(LevelInfo, msg, keyvals) }
+
+// Warn logs msg with the key value pairs in keyvals
+func (l *Logger) Warn(msg string, keyvals ...interface{}) { l.log(LevelWarn, msg, keyvals) }
+
+// Error logs msg with the key value pairs in keyvals
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+func (l *Logger) log(level int, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+	fields := append([]interface{}{
+		"ts", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", levelNames[level],
+		"msg", msg,
+	}, keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+
+	var line bytes.Buffer
+	line.WriteString(l.prefix)
+	if l.format == LogFormatJSON {
+		writeJSONFields(&line, fields)
+	} else {
+		writeLogfmtFields(&line, fields)
+	}
+	line.WriteByte('\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// there is nowhere left to report a failing log sink
+	_, _ = l.out.Write(line.Bytes())
+}
+
+// logValue turns values into something readable, errors and durations would otherwise be encoded as structs
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+func writeLogfmtFields(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(buf, "%v=", fields[i])
+		value := fmt.Sprint(logValue(fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = fmt.Sprintf("%q", value)
+		}
+		buf.WriteString(value)
+	}
+}
+
+func writeJSONFields(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		value, err := json.Marshal(logValue(fields[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggerFormats(t *testing.T) {
+	var out bytes.Buffer
+	l := NewLogger(&out, LevelInfo, LogFormatLogfmt, logPrefix)
+	l.Debug("hidden")
+	l.Info("upgrade detected", "upgrade", "chain 2", "height", 49, "empty", "")
+	l.Error("upgrade failed", "error", errors.New("no binary"), "took", 1500*time.Millisecond)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "[cosmosd] ts="))
+	assert.Contains(t, lines[0], ` level=info msg="upgrade detected" upgrade="chain 2" height=49 empty=""`)
+	assert.Contains(t, lines[1], ` level=error msg="upgrade failed" error="no binary" took=1.5s`)
+
+	out.Reset()
+	l = NewLogger(&out, LevelDebug, LogFormatJSON, "")
+	l.Debug("downloading upgrade", "upgrade", "chain2", "bytes", 2048, "error", errors.New("boom"))
+	var event map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &event))
+	assert.Equal(t, "debug", event["level"])
+	assert.Equal(t, "downloading upgrade", event["msg"])
+	assert.Equal(t, "chain2", event["upgrade"])
+	assert.Equal(t, float64(2048), event["bytes"])
+	assert.Equal(t, "boom", event["error"])
+	assert.NotEmpty(t, event["ts"])
+	// the fixed fields come first
+	assert.True(t, strings.HasPrefix(out.String(), `{"ts":`))
+}
+
+func TestOpenLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cosmosd-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cosmosd.log")
+
+	l, err := OpenLogger(&Config{LogLevel: "WARN", LogFormat: "json", LogOutput: path})
+	require.NoError(t, err)
+	l.Info("not logged")
+	l.Warn("logged")
+	bz, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(bz), "not logged")
+	assert.Contains(t, string(bz), `"msg":"logged"`)
+
+	_, err = OpenLogger(&Config{LogLevel: "verbose"})
+	require.Error(t, err)
+	_, err = OpenLogger(&Config{LogFormat: "xml"})
+	require.Error(t, err)
+	_, err = OpenLogger(&Config{LogOutput: filepath.Join(dir, "missing", "cosmosd.log")})
+	require.Error(t, err)
+}
+
+func TestLoggedEvents(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", RetainUpgrades: 1}
+
+	var out bytes.Buffer
+	defer func(l *Logger) { logger = l }(logger)
+	logger = NewLogger(&out, LevelDebug, LogFormatLogfmt, "")
+
+	// the history can't be written, which is logged rather than failing the upgrade
+	require.NoError(t, os.Mkdir(filepath.Join(cfg.Root(), historyFile), 0755))
+
+	var stdout, stderr bytes.Buffer
+	doUpgrade, err := LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	require.True(t, doUpgrade)
+	require.Error(t, DoUpgrade(cfg, &UpgradeInfo{Name: "noexec"}))
+
+	logs := out.String()
+	assert.Contains(t, logs, `msg="daemon started"`)
+	assert.Contains(t, logs, `msg="upgrade detected, daemon killed" upgrade=chain2 height=49`)
+	assert.Contains(t, logs, `msg="switched to upgrade" upgrade=chain2`)
+	assert.Contains(t, logs, `level=warn msg="recording history failed" event=switch`)
+	assert.Contains(t, logs, `level=error msg="upgrade failed" upgrade=noexec`)
+	// nothing of ours ends up in the daemon output
+	assert.NotContains(t, stdout.String()+stderr.String(), "msg=")
+}
@@ -1,29 +1,88 @@
 package main
 
 import (
-	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
 	err := Run(os.Args[1:])
 	if err != nil {
-		fmt.Printf("%+v\n", err)
+		logger.Error("cosmosd failed", "error", err)
 		os.Exit(1)
 	}
 }
 
 // Run is the main loop, but returns an error
 func Run(args []string) error {
-	cfg, err := GetConfigFromEnv()
+	// cosmosd options and commands are handled here and never reach the daemon
+	opts, args, err := ParseOptions(args)
 	if err != nil {
 		return err
 	}
-	doUpgrade, err := LaunchProcess(cfg, args, os.Stdout, os.Stderr)
+	// give the webhooks a chance to hear about what happened before we exit
+	defer func() {
+		if !FlushNotifications(notifyFlushTimeout) {
+			logger.Warn("exiting before all webhook notifications were delivered")
+		}
+	}()
+	if name, ok := ParseCommand(args); ok {
+		return RunCommand(name, opts, args[1:], os.Stdout)
+	}
+
+	cfg, err := GetConfig(opts)
+	if err != nil {
+		return err
+	}
+	l, err := OpenLogger(cfg)
+	if err != nil {
+		return err
+	}
+	logger = l
+	lock, err := cfg.Lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	// the daemon runs in its own process group, so pass SIGINT and SIGTERM on to it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			logger.Info("stopping daemon", "signal", sig)
+			daemonGroup.forward(sig)
+		}
+	}()
+	// we may have been restarted while the daemon was halted for an upgrade
+	if records, err := cfg.ReadHistory(); err != nil {
+		logger.Warn("reading history failed, metrics start from scratch", "error", err)
+	} else {
+		metrics.Restore(records)
+	}
+	if cfg.MetricsListen != "" {
+		if err := ServeMetrics(cfg); err != nil {
+			return err
+		}
+	}
+	out, err := OpenOutput(cfg)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	doUpgrade, err := LaunchProcess(cfg, args, out.Stdout, out.Stderr)
 
 	// if RestartAfterUpgrade, we launch after a successful upgrade (only condition LaunchProcess returns nil)
-	for cfg.RestartAfterUpgrade && err == nil && doUpgrade {
-		doUpgrade, err = LaunchProcess(cfg, args, os.Stdout, os.Stderr)
+	for cfg.RestartAfterUpgrade && err == nil && doUpgrade && daemonGroup.stopping() == nil {
+		logger.Info("restarting daemon after upgrade")
+		notifyStatus("restarting daemon")
+		doUpgrade, err = LaunchProcess(cfg, args, out.Stdout, out.Stderr)
+	}
+	if sig := daemonGroup.stopping(); sig != nil && !doUpgrade {
+		// we were asked to stop, the daemon exiting because of it is no failure
+		logger.Info("daemon stopped", "signal", sig)
+		return nil
 	}
 	return err
 }
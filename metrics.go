@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// metricsPath is where the metrics are served, in the prometheus text format
+const metricsPath = "/metrics"
+
+// heightRegex finds the block height in the daemon logs, eg.
+// `I[2020-06-02|10:00:00.000] Executed block module=state height=1234 validTxs=0 invalidTxs=0`
+var heightRegex = regexp.MustCompile(`\bheight=(\d+)\b`)
+
+// Metrics collects what the upgrade manager observes about the daemon.
+// All methods are safe for concurrent use.
+type Metrics struct {
+	mutex sync.Mutex
+
+	started    int
+	childStart time.Time
+	halted     time.Time
+
+	upgradesDetected  int
+	upgradesCompleted int
+	upgradesFailed    int
+
+	downloadBytes    int64
+	downloadSeconds  float64
+	downloads        int
+	downtimeSeconds  float64
+	downtimeObserved bool
+
+	height int64
+}
+
+// metrics is the collector of this process, served by ServeMetrics
+var metrics = &Metrics{}
+
+// Restore picks up the upgrade counters and downtime from the history, as the upgrade manager is
+// usually restarted between halting the daemon for an upgrade and starting it again
+func (m *Metrics) Restore(records []HistoryRecord) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, rec := range records {
+		success := rec.Outcome == OutcomeSuccess
+		switch {
+		case rec.Event == EventDetected:
+			m.upgradesDetected++
+			m.halted = rec.Time
+		case rec.Event == EventSwitch && success:
+			m.upgradesCompleted++
+		case rec.Event == EventSwitch:
+			m.upgradesFailed++
+		case rec.Event == EventDownload && success:
+			m.downloads++
+			m.downloadBytes += rec.Bytes
+			m.downloadSeconds += float64(rec.DurationMs) / 1000
+		case rec.Event == EventStarted:
+			m.downtimeSeconds = float64(rec.DurationMs) / 1000
+			m.downtimeObserved = true
+			m.halted = time.Time{}
+		}
+	}
+}
+
+// ChildStarted records the daemon was (re)started. If it was halted for an upgrade, it returns
+// when that happened.
+func (m *Metrics) ChildStarted(now time.Time) time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.started++
+	m.childStart = now
+	// we halted the daemon for an upgrade, and it is running again
+	halted := m.halted
+	if !halted.IsZero() {
+		m.downtimeSeconds = now.Sub(halted).Seconds()
+		m.downtimeObserved = true
+		m.halted = time.Time{}
+	}
+	return halted
+}
+
+// ChildExited records the daemon is no longer running
+func (m *Metrics) ChildExited() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.childStart = time.Time{}
+}
+
+// UpgradeDetected records the daemon was halted at an upgrade
+func (m *Metrics) UpgradeDetected(now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.upgradesDetected++
+	m.halted = now
+}
+
+// UpgradeDone records the outcome of switching to an upgrade
+func (m *Metrics) UpgradeDone(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err != nil {
+		m.upgradesFailed++
+	} else {
+		m.upgradesCompleted++
+	}
+}
+
+// Downloaded records a successful download of bytes, which took d
+func (m *Metrics) Downloaded(bytes int64, d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.downloads++
+	m.downloadBytes += bytes
+	m.downloadSeconds += d.Seconds()
+}
+
+// ObserveLine picks the block height from a line of the daemon logs, if there is one
+func (m *Metrics) ObserveLine(line string) {
+	subs := heightRegex.FindStringSubmatch(line)
+	if subs == nil {
+		return
+	}
+	height, err := strconv.ParseInt(subs[1], 10, 64)
+	if err != nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.height = height
+}
+
+// Expose writes all metrics in the prometheus text exposition format
+func (m *Metrics) Expose(w io.Writer, cfg *Config, now time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ew := &errWriter{w: w}
+	if dir, err := cfg.CurrentDir(); err == nil {
+		writeMetric(ew, "cosmosd_current_version_info", "gauge", "the version the current link points to",
+			fmt.Sprintf("{upgrade=%q}", versionName(cfg, dir)), 1)
+	}
+	var uptime float64
+	if !m.childStart.IsZero() {
+		uptime = now.Sub(m.childStart).Seconds()
+	}
+	restarts := 0
+	if m.started > 1 {
+		restarts = m.started - 1
+	}
+	writeMetric(ew, "cosmosd_child_uptime_seconds", "gauge", "time since the daemon was started, 0 when it is not running", "", uptime)
+	writeMetric(ew, "cosmosd_child_restarts_total", "counter", "number of times the daemon was restarted", "", float64(restarts))
+	writeMetric(ew, "cosmosd_upgrades_detected_total", "counter", "number of upgrades detected in the daemon output", "", float64(m.upgradesDetected))
+	writeMetric(ew, "cosmosd_upgrades_completed_total", "counter", "number of successful switches to an upgrade", "", float64(m.upgradesCompleted))
+	writeMetric(ew, "cosmosd_upgrades_failed_total", "counter", "number of failed switches to an upgrade", "", float64(m.upgradesFailed))
+	writeMetric(ew, "cosmosd_download_bytes_total", "counter", "size of all downloaded upgrades", "", float64(m.downloadBytes))
+	writeHeader(ew, "cosmosd_download_duration_seconds", "summary", "time spent downloading upgrades")
+	writeSample(ew, "cosmosd_download_duration_seconds_sum", "", m.downloadSeconds)
+	writeSample(ew, "cosmosd_download_duration_seconds_count", "", float64(m.downloads))
+	if m.downtimeObserved {
+		writeMetric(ew, "cosmosd_upgrade_downtime_seconds", "gauge", "time from halting the daemon at the last upgrade to restarting it", "", m.downtimeSeconds)
+	}
+	if m.height > 0 {
+		writeMetric(ew, "cosmosd_block_height", "gauge", "last block height seen in the daemon logs", "", float64(m.height))
+	}
+	return ew.err
+}
+
+// writeMetric writes a metric with a single sample
+func writeMetric(w io.Writer, name, typ, help, labels string, value float64) {
+	writeHeader(w, name, typ, help)
+	writeSample(w, name, labels, value)
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(w io.Writer, name, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// errWriter remembers the first write error, so a series of writes only needs to be checked once
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.w.Write(p)
+	e.err = err
+	return n, err
+}
+
+// versionName returns the name of the version in dir: genesis or the upgrade name
+func versionName(cfg *Config, dir string) string {
+	if dir == cfg.GenesisDir() {
+		return genesisDir
+	}
+	name, err := url.PathUnescape(filepath.Base(dir))
+	if err != nil {
+		return filepath.Base(dir)
+	}
+	return name
+}
+
+// MetricsHandler serves the metrics of m
+func MetricsHandler(cfg *Config, m *Metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = m.Expose(w, cfg, time.Now())
+	})
+}
+
+// ServeMetrics starts serving the metrics on cfg.MetricsListen in the background.
+// It returns once the address is bound, so a bad address fails the start of the upgrade manager.
+func ServeMetrics(cfg *Config) error {
+	listener, err := net.Listen("tcp", cfg.MetricsListen)
+	if err != nil {
+		return errors.Wrap(err, "listening for metrics")
+	}
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, MetricsHandler(cfg, metrics))
+	go func() {
+		_ = http.Serve(listener, mux)
+	}()
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsExpose(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	var m Metrics
+	start := time.Date(2020, 6, 2, 10, 0, 0, 0, time.UTC)
+	m.ChildStarted(start)
+	m.ObserveLine("I[2020-06-02|10:00:00.000] Executed block    module=state height=1234 validTxs=0 invalidTxs=0")
+	m.ObserveLine("I[2020-06-02|10:00:00.000] no height in here")
+	m.UpgradeDetected(start.Add(time.Minute))
+	m.ChildExited()
+	m.Downloaded(2048, 1500*time.Millisecond)
+	m.UpgradeDone(nil)
+	m.UpgradeDone(errors.New("no binary"))
+	m.ChildStarted(start.Add(90 * time.Second))
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+
+	var out bytes.Buffer
+	require.NoError(t, m.Expose(&out, cfg, start.Add(100*time.Second)))
+	text := out.String()
+	for _, sample := range []string{
+		"# TYPE cosmosd_current_version_info gauge\ncosmosd_current_version_info{upgrade=\"chain2\"} 1\n",
+		"\ncosmosd_child_uptime_seconds 10\n",
+		"\ncosmosd_child_restarts_total 1\n",
+		"\ncosmosd_upgrades_detected_total 1\n",
+		"\ncosmosd_upgrades_completed_total 1\n",
+		"\ncosmosd_upgrades_failed_total 1\n",
+		"\ncosmosd_download_bytes_total 2048\n",
+		"# TYPE cosmosd_download_duration_seconds summary\n",
+		"\ncosmosd_download_duration_seconds_sum 1.5\ncosmosd_download_duration_seconds_count 1\n",
+		"\ncosmosd_upgrade_downtime_seconds 30\n",
+		"\ncosmosd_block_height 1234\n",
+	} {
+		assert.Contains(t, text, sample)
+	}
+
+	// nothing observed yet, the optional metrics are left out
+	out.Reset()
+	require.NoError(t, (&Metrics{}).Expose(&out, cfg, start))
+	assert.Contains(t, out.String(), "cosmosd_child_uptime_seconds 0\n")
+	assert.NotContains(t, out.String(), "cosmosd_upgrade_downtime_seconds")
+	assert.NotContains(t, out.String(), "cosmosd_block_height")
+}
+
+func TestMetricsRestore(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	defer func(m *Metrics) { metrics = m }(metrics)
+	metrics = &Metrics{}
+
+	// a previous upgrade manager halted the daemon for chain2 and exited after switching
+	halted := time.Now().Add(-time.Minute).UTC()
+	records := []HistoryRecord{
+		{Event: EventDetected, Time: halted.Add(-time.Hour), Outcome: OutcomeSuccess},
+		{Event: EventSwitch, Outcome: OutcomeFailure},
+		{Event: EventStarted, DurationMs: 5000, Outcome: OutcomeSuccess},
+		{Event: EventDetected, Time: halted, Outcome: OutcomeSuccess},
+		{Event: EventDownload, Bytes: 2048, DurationMs: 1500, Outcome: OutcomeSuccess},
+		{Event: EventDownload, DurationMs: 100, Outcome: OutcomeFailure},
+		{Event: EventSwitch, Outcome: OutcomeSuccess},
+	}
+	for _, rec := range records {
+		require.NoError(t, cfg.AppendHistory(rec))
+	}
+	history, err := cfg.ReadHistory()
+	require.NoError(t, err)
+	metrics.Restore(history)
+
+	var out bytes.Buffer
+	require.NoError(t, metrics.Expose(&out, cfg, time.Now()))
+	for _, sample := range []string{
+		"\ncosmosd_upgrades_detected_total 2\n",
+		"\ncosmosd_upgrades_completed_total 1\n",
+		"\ncosmosd_upgrades_failed_total 1\n",
+		"\ncosmosd_download_bytes_total 2048\n",
+		"\ncosmosd_download_duration_seconds_sum 1.5\ncosmosd_download_duration_seconds_count 1\n",
+		"\ncosmosd_upgrade_downtime_seconds 5\n",
+	} {
+		assert.Contains(t, out.String(), sample)
+	}
+
+	// starting the daemon ends the downtime, and records it for the next upgrade manager
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	_, err = LaunchProcess(cfg, []string{"foo"}, ioutil.Discard, ioutil.Discard)
+	require.NoError(t, err)
+	history, err = cfg.ReadHistory()
+	require.NoError(t, err)
+	last := history[len(history)-1]
+	assert.Equal(t, EventStarted, last.Event)
+	assert.True(t, last.DurationMs >= 60000, last.DurationMs)
+
+	restored := &Metrics{}
+	restored.Restore(history)
+	assert.True(t, restored.halted.IsZero())
+	assert.Equal(t, float64(last.DurationMs)/1000, restored.downtimeSeconds)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	metrics = &Metrics{}
+	server := httptest.NewServer(MetricsHandler(cfg, metrics))
+	defer server.Close()
+
+	// genesis halts at the chain2 upgrade, and chain2 is restarted
+	var stdout, stderr bytes.Buffer
+	doUpgrade, err := LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	require.True(t, doUpgrade)
+	_, err = LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+
+	res, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Content-Type"), "text/plain")
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `cosmosd_current_version_info{upgrade="chain2"} 1`)
+	assert.Contains(t, string(body), "cosmosd_child_restarts_total 1\n")
+	assert.Contains(t, string(body), "cosmosd_upgrades_detected_total 1\n")
+	assert.Contains(t, string(body), "cosmosd_upgrades_completed_total 1\n")
+	assert.Contains(t, string(body), "cosmosd_upgrade_downtime_seconds ")
+
+	// a bad address fails right away
+	cfg.MetricsListen = "not-an-address"
+	require.Error(t, ServeMetrics(cfg))
+}
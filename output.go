@@ -0,0 +1,312 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rotatedTimeFormat is appended to the name of rotated files, it sorts in chronological order
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// RotatingFile is a log file which is rotated once it exceeds maxSize bytes or is older than every
+// (either may be 0 to disable it). Rotated files are gzipped in the background, and only the newest
+// retain are kept (0 keeps all).
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	every   time.Duration
+	retain  int
+
+	mutex sync.Mutex
+	// file is nil after Close, or while it couldn't be reopened
+	file   *os.File
+	closed bool
+	size   int64
+	opened time.Time
+	// compressing tracks the rotated files being gzipped
+	compressing sync.WaitGroup
+}
+
+// OpenRotatingFile opens (or appends to) the log file at path
+func OpenRotatingFile(path string, maxSize int64, every time.Duration, retain int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, every: every, retain: retain}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "opening output file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "opening output file")
+	}
+	r.file, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if needed
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return 0, errors.New("output file is closed")
+	}
+	// a failed rotation or reopen left us without a file, try again
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	full := r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize
+	old := r.every > 0 && time.Since(r.opened) >= r.every
+	if full || old {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Reopen closes and reopens the file, eg. after an external tool moved it away
+func (r *RotatingFile) Reopen() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return errors.New("output file is closed")
+	}
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	return r.open()
+}
+
+// Close closes the file, waiting for rotated files to be compressed
+func (r *RotatingFile) Close() error {
+	r.mutex.Lock()
+	var err error
+	if r.file != nil {
+		err = r.file.Close()
+		r.file = nil
+	}
+	r.closed = true
+	r.mutex.Unlock()
+	r.compressing.Wait()
+	return err
+}
+
+// rotate moves the current file aside and starts a new one, must be called with the mutex held.
+// If the file can't be moved, it is reopened to keep writing to it.
+func (r *RotatingFile) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+	if err != nil {
+		return errors.Wrap(err, "closing output file")
+	}
+	rotated := r.path + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(r.path, rotated); err != nil {
+		if oerr := r.open(); oerr != nil {
+			logger.Warn("reopening output file failed", "file", r.path, "error", oerr)
+		}
+		return errors.Wrap(err, "rotating output file")
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	r.compressing.Add(1)
+	go func() {
+		defer r.compressing.Done()
+		if err := compressFile(rotated); err != nil {
+			logger.Warn("compressing rotated output failed", "file", rotated, "error", err)
+			return
+		}
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if err := r.removeOld(); err != nil {
+			logger.Warn("removing old output failed", "file", r.path, "error", err)
+		}
+	}()
+	return nil
+}
+
+// Rotated returns the compressed rotated files, oldest first
+func (r *RotatingFile) Rotated() ([]string, error) {
+	files, err := filepath.Glob(r.path + ".*.gz")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (r *RotatingFile) removeOld() error {
+	if r.retain <= 0 {
+		return nil
+	}
+	files, err := r.Rotated()
+	if err != nil {
+		return err
+	}
+	for len(files) > r.retain {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// compressFile replaces path with path.gz
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".gz.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := gzip.NewWriter(tmp)
+	if _, err := io.Copy(zw, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// droppingWriter is an output file sink which never fails: the daemon output is read through it (see
+// LaunchProcess), and an error would stop reading the pipe and stall the daemon. Failed writes (eg. on a
+// full disk) are logged and dropped.
+type droppingWriter struct {
+	w       io.Writer
+	path    string
+	mutex   sync.Mutex
+	failing bool
+}
+
+func (d *droppingWriter) Write(p []byte) (int, error) {
+	_, err := d.w.Write(p)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	// log once until writing works again, not on every line
+	switch {
+	case err != nil && !d.failing:
+		logger.Error("writing output file failed, dropping output", "file", d.path, "error", err)
+	case err == nil && d.failing:
+		logger.Info("writing output file works again", "file", d.path)
+	}
+	d.failing = err != nil
+	return len(p), nil
+}
+
+// Output is where the daemon output goes: cosmosd's own stdout and stderr, and/or rotating files
+type Output struct {
+	Stdout io.Writer
+	Stderr io.Writer
+	files  []*RotatingFile
+	hangup chan os.Signal
+}
+
+// OpenOutput sets up the daemon output as configured. With an output dir, stdout and stderr are
+// written to $DAEMON_NAME.stdout.log and $DAEMON_NAME.stderr.log there, and reopened on SIGHUP.
+func OpenOutput(cfg *Config) (*Output, error) {
+	out := &Output{Stdout: os.Stdout, Stderr: os.Stderr}
+	if cfg.OutputDir == "" {
+		return out, nil
+	}
+	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "creating output dir")
+	}
+	var writers []io.Writer
+	for _, stream := range []string{"stdout", "stderr"} {
+		path := filepath.Join(cfg.OutputDir, cfg.Name+"."+stream+".log")
+		f, err := OpenRotatingFile(path, int64(cfg.OutputMaxSize)*1024*1024, cfg.OutputRotateEvery, cfg.OutputRetain)
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+		out.files = append(out.files, f)
+		writers = append(writers, &droppingWriter{w: f, path: path})
+	}
+
+	if cfg.OutputNoPassthrough {
+		out.Stdout, out.Stderr = writers[0], writers[1]
+	} else {
+		out.Stdout, out.Stderr = io.MultiWriter(os.Stdout, writers[0]), io.MultiWriter(os.Stderr, writers[1])
+	}
+	out.reopenOnHangup()
+	return out, nil
+}
+
+// Reopen reopens all output files
+func (o *Output) Reopen() error {
+	for _, f := range o.files {
+		if err := f.Reopen(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all output files
+func (o *Output) Close() error {
+	if o.hangup != nil {
+		signal.Stop(o.hangup)
+		close(o.hangup)
+		o.hangup = nil
+	}
+	var res error
+	for _, f := range o.files {
+		if err := f.Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+func (o *Output) reopenOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	o.hangup = hangup
+	go func() {
+		for range hangup {
+			if err := o.Reopen(); err != nil {
+				logger.Error("reopening output failed", "error", err)
+			} else {
+				logger.Info("reopened output", "dir", filepath.Dir(o.files[0].path))
+			}
+		}
+	}()
+}
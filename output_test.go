@@ -0,0 +1,164 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readGzip(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	return string(bz)
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotating-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dummyd.stdout.log")
+
+	// rotate by size, keeping the last 2 rotated files
+	r, err := OpenRotatingFile(path, 10, 0, 2)
+	require.NoError(t, err)
+	for _, line := range []string{"line one\n", "line two\n", "line three\n", "line four\n"} {
+		_, err = r.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	require.NoError(t, r.Close())
+
+	bz, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "line four\n", string(bz))
+	rotated, err := r.Rotated()
+	require.NoError(t, err)
+	require.Len(t, rotated, 2)
+	assert.Equal(t, "line two\n", readGzip(t, rotated[0]))
+	assert.Equal(t, "line three\n", readGzip(t, rotated[1]))
+	// nothing uncompressed is left behind
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	// rotate by age, appending to the existing file
+	r, err = OpenRotatingFile(path, 0, 50*time.Millisecond, 0)
+	require.NoError(t, err)
+	_, err = r.Write([]byte("line five\n"))
+	require.NoError(t, err)
+	time.Sleep(60 * time.Millisecond)
+	_, err = r.Write([]byte("line six\n"))
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	rotated, err = r.Rotated()
+	require.NoError(t, err)
+	require.Len(t, rotated, 3)
+	assert.Equal(t, "line four\nline five\n", readGzip(t, rotated[2]))
+	_, err = r.Write([]byte("closed"))
+	require.Error(t, err)
+}
+
+func TestRotatingFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotating-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dummyd.stdout.log")
+
+	r, err := OpenRotatingFile(path, 10, 0, 0)
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = r.Write([]byte("line one\n"))
+	require.NoError(t, err)
+
+	// the file is gone, so rotating fails, but it is reopened right away
+	require.NoError(t, os.Remove(path))
+	_, err = r.Write([]byte("line two\n"))
+	require.Error(t, err)
+	_, err = r.Write([]byte("line three\n"))
+	require.NoError(t, err)
+	bz, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "line three\n", string(bz))
+
+	// the output sink never fails, so the daemon output keeps being read
+	sink := &droppingWriter{w: r, path: path}
+	require.NoError(t, os.RemoveAll(dir))
+	n, err := sink.Write([]byte("line four\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.True(t, sink.failing)
+	require.NoError(t, os.Mkdir(dir, 0755))
+	_, err = sink.Write([]byte("line five\n"))
+	require.NoError(t, err)
+	assert.False(t, sink.failing)
+	bz, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "line five\n", string(bz))
+}
+
+func TestOutput(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	outDir := filepath.Join(home, "logs")
+	cfg := &Config{Home: home, Name: "dummyd", OutputDir: outDir, OutputNoPassthrough: true}
+
+	out, err := OpenOutput(cfg)
+	require.NoError(t, err)
+	defer out.Close()
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	_, err = LaunchProcess(cfg, []string{"foo"}, out.Stdout, out.Stderr)
+	require.NoError(t, err)
+
+	stdout := filepath.Join(outDir, "dummyd.stdout.log")
+	bz, err := ioutil.ReadFile(stdout)
+	require.NoError(t, err)
+	assert.Equal(t, "Chain 2 is live!\nArgs: foo\nFinished successfully\n", string(bz))
+	_, err = os.Stat(filepath.Join(outDir, "dummyd.stderr.log"))
+	require.NoError(t, err)
+
+	// an external tool moves the file away and sends SIGHUP
+	require.NoError(t, os.Rename(stdout, stdout+".1"))
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(stdout); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	_, err = out.Stdout.Write([]byte("after reopen\n"))
+	require.NoError(t, err)
+	bz, err = ioutil.ReadFile(stdout)
+	require.NoError(t, err)
+	assert.Equal(t, "after reopen\n", string(bz))
+
+	// without an output dir, the output goes to our own stdio
+	plain, err := OpenOutput(&Config{Name: "dummyd"})
+	require.NoError(t, err)
+	assert.Equal(t, os.Stdout, plain.Stdout)
+	assert.Equal(t, os.Stderr, plain.Stderr)
+}
+
+func TestDurationSetting(t *testing.T) {
+	var cfg Config
+	require.NoError(t, applySettings(&cfg, map[string]string{"output_rotate_every": "24h", "output_max_size": "100"}, "test"))
+	assert.Equal(t, 24*time.Hour, cfg.OutputRotateEvery)
+	assert.Equal(t, 100, cfg.OutputMaxSize)
+	err := applySettings(&cfg, map[string]string{"output_rotate_every": "daily"}, "test")
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "DAEMON_OUTPUT_ROTATE_EVERY"))
+}
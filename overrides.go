@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// argsFile in a version directory patches the daemon arguments for that version only
+	argsFile = "args"
+	// envFile in a version directory patches the daemon environment for that version only
+	envFile = "env"
+	// libDir in a version directory holds shared libraries shipped with the binary (eg. libwasmvm.so)
+	libDir = "lib"
+	// libraryPathEnv is where the dynamic loader looks for shared libraries
+	libraryPathEnv = "LD_LIBRARY_PATH"
+)
+
+// VersionDir returns the version directory (genesis or upgrades/<name>) holding bin/$DAEMON_NAME
+func VersionDir(bin string) string {
+	return filepath.Dir(filepath.Dir(bin))
+}
+
+// VersionArgs applies the args file of the version directory (if any) to the daemon arguments.
+// Each line of the file is one of the following (empty lines and lines starting with # are ignored):
+//
+//	add <arg>            append the argument
+//	set <flag>=<value>   replace the value of the flag (--flag=x or --flag x), or append it if missing
+//	set <flag>           set a boolean flag (--flag or --flag=x), or append it if missing
+//	remove <flag>=       drop the flag along with its value (--flag=x or --flag x)
+//	remove <flag>        drop a boolean flag (--flag or --flag=x)
+//	rename <old> <new>   rename the flag, keeping its value
+//
+// Only the directives for flags taking a value drop the argument after the flag, a boolean flag may be followed
+// by anything (eg. `--trace start`).
+func VersionArgs(dir string, args []string) ([]string, error) {
+	lines, err := readOverrides(filepath.Join(dir, argsFile))
+	if err != nil {
+		return nil, err
+	}
+	res := append([]string{}, args...)
+	for _, line := range lines {
+		fields := strings.Fields(line.text)
+		verb, params := fields[0], fields[1:]
+		switch {
+		case verb == "add" && len(params) == 1:
+			res = append(res, params[0])
+		case verb == "set" && len(params) == 1:
+			res = setFlag(res, params[0])
+		case verb == "remove" && len(params) == 1:
+			res = removeFlag(res, strings.TrimSuffix(params[0], "="), strings.HasSuffix(params[0], "="))
+		case verb == "rename" && len(params) == 2:
+			res = renameFlag(res, params[0], params[1])
+		default:
+			return nil, errors.Errorf("%s:%d: invalid directive %q", filepath.Join(dir, argsFile), line.num, line.text)
+		}
+	}
+	return res, nil
+}
+
+// VersionEnv applies the env file of the version directory (if any) to the environment env.
+// Each line is either KEY=VALUE to set a variable, or `unset KEY` to remove it.
+func VersionEnv(dir string, env []string) ([]string, error) {
+	lines, err := readOverrides(filepath.Join(dir, envFile))
+	if err != nil {
+		return nil, err
+	}
+	res := append([]string{}, env...)
+	for _, line := range lines {
+		if strings.HasPrefix(line.text, "unset ") {
+			res = unsetEnv(res, strings.TrimSpace(strings.TrimPrefix(line.text, "unset ")))
+			continue
+		}
+		i := strings.Index(line.text, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("%s:%d: expected KEY=VALUE or unset KEY, got %q", filepath.Join(dir, envFile), line.num, line.text)
+		}
+		res = setEnv(res, line.text[:i], line.text[i+1:])
+	}
+	return res, nil
+}
+
+// VersionLibraryPath prepends the lib directory of the version directory (if any) to LD_LIBRARY_PATH,
+// so every version loads its own copy of the shared libraries it ships with
+func VersionLibraryPath(dir string, env []string) []string {
+	lib := filepath.Join(dir, libDir)
+	if info, err := os.Stat(lib); err != nil || !info.IsDir() {
+		return env
+	}
+	if abs, err := filepath.Abs(lib); err == nil {
+		lib = abs
+	}
+	for _, kv := range env {
+		if strings.HasPrefix(kv, libraryPathEnv+"=") && kv != libraryPathEnv+"=" {
+			return setEnv(env, libraryPathEnv, lib+string(os.PathListSeparator)+strings.TrimPrefix(kv, libraryPathEnv+"="))
+		}
+	}
+	return setEnv(env, libraryPathEnv, lib)
+}
+
+type overrideLine struct {
+	num  int
+	text string
+}
+
+// readOverrides returns the meaningful lines of an override file, or nothing if there is no such file
+func readOverrides(path string) ([]overrideLine, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "opening overrides")
+	}
+	defer f.Close()
+
+	var lines []overrideLine
+	scan := bufio.NewScanner(f)
+	for num := 1; scan.Scan(); num++ {
+		text := strings.TrimSpace(scan.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		lines = append(lines, overrideLine{num: num, text: text})
+	}
+	return lines, errors.Wrapf(scan.Err(), "reading %s", path)
+}
+
+// flagValueAt reports whether args[i] is the flag, and how many arguments it spans
+// (2 if the flag takes a value passed as the next argument, eg. `--home /foo`)
+func flagValueAt(args []string, i int, flag string, takesValue bool) (bool, int) {
+	arg := args[i]
+	if strings.HasPrefix(arg, flag+"=") {
+		return true, 1
+	}
+	if arg != flag {
+		return false, 0
+	}
+	if takesValue && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+		return true, 2
+	}
+	return true, 1
+}
+
+// setFlag replaces the flag with assignment, which is either `--flag=value` or a boolean `--flag`
+func setFlag(args []string, assignment string) []string {
+	flag := strings.SplitN(assignment, "=", 2)[0]
+	takesValue := flag != assignment
+	res := make([]string, 0, len(args)+1)
+	found := false
+	for i := 0; i < len(args); i++ {
+		if ok, n := flagValueAt(args, i, flag, takesValue); ok {
+			if !found {
+				res = append(res, assignment)
+				found = true
+			}
+			i += n - 1
+			continue
+		}
+		res = append(res, args[i])
+	}
+	if !found {
+		res = append(res, assignment)
+	}
+	return res
+}
+
+func removeFlag(args []string, flag string, takesValue bool) []string {
+	res := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		if ok, n := flagValueAt(args, i, flag, takesValue); ok {
+			i += n - 1
+			continue
+		}
+		res = append(res, args[i])
+	}
+	return res
+}
+
+func renameFlag(args []string, from, to string) []string {
+	res := make([]string, 0, len(args))
+	for _, arg := range args {
+		switch {
+		case arg == from:
+			arg = to
+		case strings.HasPrefix(arg, from+"="):
+			arg = to + strings.TrimPrefix(arg, from)
+		}
+		res = append(res, arg)
+	}
+	return res
+}
+
+func setEnv(env []string, key, value string) []string {
+	return append(unsetEnv(env, key), key+"="+value)
+}
+
+func unsetEnv(env []string, key string) []string {
+	res := make([]string, 0, len(env))
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, key+"=") {
+			res = append(res, kv)
+		}
+	}
+	return res
+}
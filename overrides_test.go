@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionArgs(t *testing.T) {
+	cases := map[string]struct {
+		file   string
+		args   []string
+		expect []string
+		isErr  bool
+	}{
+		"no file": {
+			args:   []string{"start", "--home", "/foo"},
+			expect: []string{"start", "--home", "/foo"},
+		},
+		"add": {
+			file:   "# new flag in v2\nadd --x-crisis-skip-assert-invariants\n\n",
+			args:   []string{"start"},
+			expect: []string{"start", "--x-crisis-skip-assert-invariants"},
+		},
+		"set existing separate and inline values": {
+			file:   "set --home=/bar\nset --log_level=info",
+			args:   []string{"start", "--home", "/foo", "--log_level=debug", "--trace"},
+			expect: []string{"start", "--home=/bar", "--log_level=info", "--trace"},
+		},
+		"set missing": {
+			file:   "set --pruning=nothing",
+			args:   []string{"start"},
+			expect: []string{"start", "--pruning=nothing"},
+		},
+		"set boolean": {
+			file:   "set --trace\nset --x-crisis-skip-assert-invariants",
+			args:   []string{"--trace=false", "start", "--x-crisis-skip-assert-invariants", "--home", "/foo"},
+			expect: []string{"--trace", "start", "--x-crisis-skip-assert-invariants", "--home", "/foo"},
+		},
+		"remove": {
+			file:   "remove --trace\nremove --home=",
+			args:   []string{"start", "--trace", "--home", "/foo", "--other"},
+			expect: []string{"start", "--other"},
+		},
+		"remove boolean keeps the next argument": {
+			file:   "remove --trace\nremove --home=",
+			args:   []string{"--trace", "start", "--home=/foo", "--trace=true"},
+			expect: []string{"start"},
+		},
+		"rename": {
+			file:   "rename --rpc.laddr --rpc-laddr",
+			args:   []string{"start", "--rpc.laddr=tcp://0.0.0.0:26657", "--rpc.laddrx"},
+			expect: []string{"start", "--rpc-laddr=tcp://0.0.0.0:26657", "--rpc.laddrx"},
+		},
+		"invalid directive": {
+			file:  "replace --foo --bar",
+			isErr: true,
+		},
+		"set with separate value": {
+			file:  "set --foo bar",
+			isErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "version-args")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			if tc.file != "" {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(dir, argsFile), []byte(tc.file), 0644))
+			}
+
+			args, err := VersionArgs(dir, tc.args)
+			if tc.isErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, args)
+		})
+	}
+}
+
+func TestVersionEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "version-env")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	env := []string{"HOME=/root", "GOGC=100", "DEBUG=1"}
+	res, err := VersionEnv(dir, env)
+	require.NoError(t, err)
+	assert.Equal(t, env, res)
+
+	file := "# tune gc\nGOGC=400\nWASMVM_CACHE=/tmp/wasm=cache\nunset DEBUG\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, envFile), []byte(file), 0644))
+	res, err = VersionEnv(dir, env)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"HOME=/root", "GOGC=400", "WASMVM_CACHE=/tmp/wasm=cache"}, res)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, envFile), []byte("JUSTAKEY\n"), 0644))
+	_, err = VersionEnv(dir, env)
+	require.Error(t, err)
+}
+
+func TestLaunchProcessWithOverrides(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// a version that prints its environment
+	bin := cfg.UpgradeBin("printenv")
+	require.NoError(t, os.MkdirAll(filepath.Dir(bin), 0755))
+	require.NoError(t, ioutil.WriteFile(bin, []byte("#!/bin/sh\necho Args: $@\necho GOGC=$GOGC\n"), 0755))
+	dir := cfg.UpgradeDir("printenv")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, argsFile), []byte("rename --old --new\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, envFile), []byte("GOGC=off\n"), 0644))
+	require.NoError(t, cfg.SetCurrentUpgrade("printenv"))
+
+	var stdout, stderr bytes.Buffer
+	_, err = LaunchProcess(cfg, []string{"start", "--old=1"}, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Equal(t, "Args: start --new=1\nGOGC=off\n", stdout.String())
+
+	// other versions are not affected
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	stdout.Reset()
+	_, err = LaunchProcess(cfg, []string{"start", "--old=1"}, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "Args: start --old=1\n")
+}
+
+func TestVersionLibraryPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "version-lib")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	lib := filepath.Join(dir, libDir)
+
+	// nothing to do without a lib directory
+	env := []string{"HOME=/root", "LD_LIBRARY_PATH=/usr/local/lib"}
+	assert.Equal(t, env, VersionLibraryPath(dir, env))
+
+	require.NoError(t, os.Mkdir(lib, 0755))
+	assert.Equal(t, []string{"HOME=/root", "LD_LIBRARY_PATH=" + lib + ":/usr/local/lib"}, VersionLibraryPath(dir, env))
+	assert.Equal(t, []string{"HOME=/root", "LD_LIBRARY_PATH=" + lib}, VersionLibraryPath(dir, []string{"HOME=/root"}))
+	assert.Equal(t, []string{"LD_LIBRARY_PATH=" + lib}, VersionLibraryPath(dir, []string{"LD_LIBRARY_PATH="}))
+}
+
+func TestLaunchProcessWithLibraries(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	for _, name := range []string{"wasm1", "wasm2"} {
+		bin := cfg.UpgradeBin(name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(bin), 0755))
+		require.NoError(t, os.MkdirAll(filepath.Join(cfg.UpgradeDir(name), libDir), 0755))
+		require.NoError(t, ioutil.WriteFile(bin, []byte("#!/bin/sh\necho $LD_LIBRARY_PATH\n"), 0755))
+	}
+
+	// each version gets its own lib directory, and only that one
+	for _, name := range []string{"wasm1", "wasm2"} {
+		require.NoError(t, cfg.SetCurrentUpgrade(name))
+		var stdout, stderr bytes.Buffer
+		_, err = LaunchProcess(cfg, nil, &stdout, &stderr)
+		require.NoError(t, err)
+		paths := filepath.SplitList(strings.TrimSpace(stdout.String()))
+		require.NotEmpty(t, paths)
+		assert.Equal(t, filepath.Join(cfg.UpgradeDir(name), libDir), paths[0])
+		assert.NotContains(t, stdout.String(), map[string]string{"wasm1": "wasm2", "wasm2": "wasm1"}[name])
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// executable checks whether we (the effective uid and gids) may execute a file with info
+func executable(info os.FileInfo) bool {
+	perm := info.Mode().Perm()
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return perm&0111 != 0
+	}
+	uid := os.Geteuid()
+	switch {
+	case uid == 0:
+		// root may execute anything that is executable for anyone
+		return perm&0111 != 0
+	case int(stat.Uid) == uid:
+		return perm&0100 != 0
+	case inGroup(int(stat.Gid)):
+		return perm&0010 != 0
+	default:
+		return perm&0001 != 0
+	}
+}
+
+func inGroup(gid int) bool {
+	if gid == os.Getegid() {
+		return true
+	}
+	groups, err := os.Getgroups()
+	if err != nil {
+		return false
+	}
+	for _, g := range groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSecure makes sure nobody but us (or root) can replace the binary at path: neither the binary
+// nor any directory up to / may be owned by another user, or be writable by the group or the world.
+// World writable directories with the sticky bit (like /tmp) are fine, as others can't rename our files there.
+func checkSecure(path string) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return errors.Wrap(err, "resolving binary path")
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return errors.Wrap(err, "resolving binary path")
+	}
+
+	for p := resolved; ; p = filepath.Dir(p) {
+		if err := checkReplaceable(p); err != nil {
+			return err
+		}
+		if p == filepath.Dir(p) {
+			return nil
+		}
+	}
+}
+
+// checkReplaceable returns an error if users other than us (or root) may modify path itself
+func checkReplaceable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrap(err, "checking permissions")
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 && int(stat.Uid) != os.Geteuid() {
+		return errors.Errorf("%s is owned by another user (uid %d), who could replace the binary", path, stat.Uid)
+	}
+	sticky := info.IsDir() && info.Mode()&os.ModeSticky != 0
+	if perm := info.Mode().Perm(); perm&0022 != 0 && !sticky {
+		return errors.Errorf("%s is writable by its group or everyone (%#o), who could replace the binary", path, perm)
+	}
+	return nil
+}
+
+// checkBinary is EnsureBinary plus checkSecure, unless insecure permissions are explicitly allowed
+func (cfg *Config) checkBinary(path string) error {
+	if err := EnsureBinary(path); err != nil {
+		return err
+	}
+	if cfg.AllowInsecurePermissions {
+		return nil
+	}
+	return checkSecure(path)
+}
+
+// restrictPermissions removes the group and world write bits from everything in dir, as downloads
+// and archives are created according to the umask
+func restrictPermissions(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 || info.Mode().Perm()&0022 == 0 {
+			return nil
+		}
+		return os.Chmod(path, info.Mode().Perm()&^0022)
+	})
+}
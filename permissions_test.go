@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecutable(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	bin := cfg.GenesisBin()
+
+	// we own the file, so the owner bit is what counts (for root any bit will do)
+	require.NoError(t, os.Chmod(bin, 0700))
+	assert.NoError(t, EnsureBinary(bin))
+	require.NoError(t, os.Chmod(bin, 0750))
+	assert.NoError(t, EnsureBinary(bin))
+	require.NoError(t, os.Chmod(bin, 0644))
+	assert.Error(t, EnsureBinary(bin))
+	if os.Geteuid() != 0 {
+		require.NoError(t, os.Chmod(bin, 0601))
+		assert.Error(t, EnsureBinary(bin))
+	}
+
+	// MarkExecutable keeps the binary private if it already runs for us
+	require.NoError(t, os.Chmod(bin, 0700))
+	require.NoError(t, MarkExecutable(bin))
+	info, err := os.Stat(bin)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+}
+
+func TestCheckSecure(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	bin := cfg.UpgradeBin("chain2")
+
+	require.NoError(t, cfg.checkBinary(bin))
+
+	// writable binary or directory anywhere up the chain
+	for _, path := range []string{bin, filepath.Dir(bin), cfg.UpgradeDir("chain2"), cfg.Root()} {
+		require.NoError(t, os.Chmod(path, 0775))
+		err := cfg.checkBinary(bin)
+		if assert.Error(t, err, path) {
+			assert.Contains(t, err.Error(), path)
+		}
+		require.NoError(t, os.Chmod(path, 0755))
+	}
+
+	// also when reached through a symlink
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	require.NoError(t, os.Chmod(bin, 0757))
+	_, err = LaunchProcess(cfg, nil, nil, nil)
+	assert.Error(t, err)
+	assert.Error(t, cfg.SetCurrentUpgrade("chain2"))
+
+	// unless explicitly allowed
+	cfg.AllowInsecurePermissions = true
+	assert.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+
+	// world writable directories with the sticky bit are fine
+	cfg.AllowInsecurePermissions = false
+	require.NoError(t, os.Chmod(bin, 0755))
+	require.NoError(t, os.Chmod(home, 0777|os.ModeSticky))
+	assert.NoError(t, cfg.checkBinary(bin))
+}
+
+func TestRestrictPermissions(t *testing.T) {
+	home, err := copyTestData("download")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "autod"}
+
+	require.NoError(t, fetchVersion(cfg.UpgradeDir("amazonas"), cfg.Name, "testdata/repo/zip_directory/autod.zip",
+		withPwd(mustGetwd(t))))
+	err = filepath.Walk(cfg.UpgradeDir("amazonas"), func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		assert.Zero(t, info.Mode().Perm()&0022, path)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.NoError(t, cfg.checkBinary(cfg.UpgradeBin("amazonas")))
+}
+
+func mustGetwd(t *testing.T) string {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	return wd
+}
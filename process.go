@@ -1,11 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"io"
+	"os"
 	"os/exec"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -13,41 +14,125 @@ import (
 // LaunchProcess runs a subprocess and returns when the subprocess exits,
 // either when it dies, or *after* a successful upgrade.
 func LaunchProcess(cfg *Config, args []string, stdout, stderr io.Writer) (bool, error) {
-	bin, err := cfg.CurrentBin()
-	if err != nil {
-		return false, errors.Wrap(err, "error creating symlink to genesis")
+	var bin string
+	var err error
+	if cfg.DryRun {
+		// a dry run never touches current
+		bin = cfg.dryRunBin()
+	} else {
+		bin, err = cfg.CurrentBin()
+		if err != nil {
+			return false, errors.Wrap(err, "error creating symlink to genesis")
+		}
 	}
-	err = EnsureBinary(bin)
+	err = cfg.checkBinary(bin)
 	if err != nil {
 		return false, errors.Wrap(err, "current binary invalid")
 	}
 
-	cmd := exec.Command(bin, args...)
-	outpipe, err := cmd.StdoutPipe()
+	// the version we run may ship shared libraries, and patch the arguments and environment
+	dir := VersionDir(bin)
+	args, err = VersionArgs(dir, args)
 	if err != nil {
-		return false, err
+		return false, errors.Wrap(err, "applying version args")
+	}
+	env, err := VersionEnv(dir, VersionLibraryPath(dir, os.Environ()))
+	if err != nil {
+		return false, errors.Wrap(err, "applying version env")
 	}
-	errpipe, err := cmd.StderrPipe()
+	sidecarDefs, err := cfg.VersionSidecars(dir)
 	if err != nil {
 		return false, err
 	}
-	scanOut := bufio.NewScanner(io.TeeReader(outpipe, stdout))
-	scanErr := bufio.NewScanner(io.TeeReader(errpipe, stderr))
+
+	// never start a node while the old one still runs or listens
+	if err := cfg.checkNoLeftoverDaemon(); err != nil {
+		return false, err
+	}
+	if err := cfg.checkPortsFree(); err != nil {
+		return false, err
+	}
+
+	cmd := exec.Command(bin, args...)
+	cmd.Env = env
+	startInGroup(cmd)
+	// exec copies the output to us, and gives up on it outputGracePeriod after the daemon exited, in case
+	// processes it started keep it open (they are killed below)
+	// the daemon and its sidecars share the writers, so their lines never mix
+	out, errOut := &lineWriter{w: stdout}, &lineWriter{w: stderr}
+	output := newDaemonOutput(out, errOut)
+	cmd.Stdout, cmd.Stderr = output.stdout, output.stderr
+	cmd.WaitDelay = outputGracePeriod
 
 	err = cmd.Start()
 	if err != nil {
 		return false, errors.Wrapf(err, "launching process %s %s", bin, strings.Join(args, " "))
 	}
+	// let other cosmosd commands know the daemon is running
+	if err := cfg.writeDaemonPid(cmd.Process.Pid); err != nil {
+		_ = killGroup(cmd)
+		_ = cmd.Wait()
+		if gerr := ensureGroupGone(cmd.Process.Pid); gerr != nil {
+			return false, gerr
+		}
+		return false, err
+	}
+	defer cfg.removeDaemonPid()
+	daemonGroup.started(cmd.Process.Pid)
+	logger.Info("daemon started", "bin", bin, "pid", cmd.Process.Pid)
+	// sidecars run from the same version directory, after an upgrade they are started from the new one
+	sidecars := StartSidecars(sidecarDefs, dir, env, out, errOut)
+	started := time.Now()
+	if halted := metrics.ChildStarted(started); !halted.IsZero() {
+		// the downtime survives restarts of the upgrade manager, see Metrics.Restore
+		cfg.appendHistory(HistoryRecord{Event: EventStarted, NewTarget: dir}, halted, nil)
+	}
+	defer metrics.ChildExited()
+	notifySystemd("READY=1\nSTATUS=running " + versionName(cfg, dir))
+	stopWatchdog := startWatchdog()
 
-	// three ways to exit - command ends, find regexp in scanOut, find regexp in scanErr
-	upgradeInfo, err := WaitForUpgradeOrExit(cmd, scanOut, scanErr)
+	// two ways to exit - command ends, or find regexp in its output
+	// (in a dry run, upgrades are only recorded and the daemon keeps running)
+	var upgradeInfo *UpgradeInfo
+	if cfg.DryRun {
+		err = ObserveUpgrades(cmd, output, cfg.recordDryRun)
+	} else {
+		upgradeInfo, err = WaitForUpgradeOrExit(cmd, output)
+	}
+	stopWatchdog()
+	sidecars.Stop()
+	// anything the daemon started must be gone before we touch the binaries or start another daemon
+	if gerr := ensureGroupGone(cmd.Process.Pid); gerr != nil {
+		logger.Error("daemon did not stop", "bin", bin, "error", gerr)
+		return false, gerr
+	}
+	daemonGroup.exited()
+	if err != nil && daemonGroup.stopping() != nil {
+		// we stopped it ourselves, Run doesn't treat this as a failure
+		logger.Info("daemon stopped", "bin", bin, "signal", daemonGroup.stopping(), "error", err)
+		return false, err
+	}
 	if err != nil {
+		logger.Error("daemon exited", "bin", bin, "error", err)
+		notifyStatus("daemon exited: " + err.Error())
+		// the supervisor restarts us, so this may be one of many crashes in a row
+		cfg.notify(Notification{
+			Event:   NotifyDaemonCrashed,
+			Target:  dir,
+			Message: "daemon exited after " + time.Since(started).Round(time.Second).String(),
+		}, err)
 		return false, err
 	}
 	if upgradeInfo != nil {
+		logger.Info("upgrade detected, daemon killed", "upgrade", upgradeInfo.Name, "height", upgradeInfo.Height, "time", upgradeInfo.Time)
+		metrics.UpgradeDetected(time.Now())
+		notifyStatus("upgrade " + upgradeInfo.Name + " detected, daemon stopped")
+		cfg.notify(Notification{Event: NotifyUpgradeDetected, Upgrade: upgradeInfo}, nil)
+		cfg.appendHistory(HistoryRecord{Event: EventDetected, Upgrade: upgradeInfo}, time.Now(), nil)
 		return true, DoUpgrade(cfg, upgradeInfo)
 	}
 
+	logger.Info("daemon exited", "bin", bin)
 	return false, nil
 }
 
@@ -90,39 +175,96 @@ func (u *WaitResult) SetUpgrade(up *UpgradeInfo) {
 	}
 }
 
-// WaitForUpgradeOrExit listens to both output streams of the process, as well as the process state itself
-// When it returns, the process is finished and all streams have closed.
+// daemonOutput receives the output of the daemon from exec. It copies it to our output line by line,
+// and collects the upgrade messages in it.
+type daemonOutput struct {
+	stdout, stderr *lineSplitter
+
+	mutex    sync.Mutex
+	upgrades []*UpgradeInfo
+	// found is signaled whenever upgrades were added
+	found chan struct{}
+}
+
+func newDaemonOutput(stdout, stderr *lineWriter) *daemonOutput {
+	o := &daemonOutput{found: make(chan struct{}, 1)}
+	o.stdout = &lineSplitter{out: stdout, onLine: o.line}
+	o.stderr = &lineSplitter{out: stderr, onLine: o.line}
+	return o
+}
+
+// line is called for every line of output, from the goroutines of exec copying stdout and stderr
+func (o *daemonOutput) line(line string) {
+	metrics.ObserveLine(line)
+	info, err := ParseUpgrade(line)
+	if err != nil {
+		logger.Warn("ignoring invalid upgrade message", "line", line, "error", err)
+	}
+	if info == nil {
+		return
+	}
+	o.mutex.Lock()
+	o.upgrades = append(o.upgrades, info)
+	o.mutex.Unlock()
+	select {
+	case o.found <- struct{}{}:
+	default:
+	}
+}
+
+// flush passes on the last lines if they had no newline, once exec is done with the output
+func (o *daemonOutput) flush() {
+	o.stdout.flush()
+	o.stderr.flush()
+}
+
+// take returns the upgrades found since the last call
+func (o *daemonOutput) take() []*UpgradeInfo {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	upgrades := o.upgrades
+	o.upgrades = nil
+	return upgrades
+}
+
+// waitExit waits for cmd in the background. Processes it started may keep its output open after it exited,
+// Wait gives up on them after WaitDelay: that is no failure of cmd.
+func waitExit(cmd *exec.Cmd) <-chan error {
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		if err == exec.ErrWaitDelay {
+			logger.Warn("processes started by the daemon kept its output open after it exited", "pid", cmd.Process.Pid)
+			err = nil
+		}
+		exited <- err
+	}()
+	return exited
+}
+
+// WaitForUpgradeOrExit watches the output of the process, as well as the process state itself.
+// When it returns, the process is finished and its output was copied (or given up on, see waitExit).
 //
 // It returns (info, nil) if an upgrade should be initiated (and we killed the process)
-// It returns (nil, err) if the process died by itself, or there was an issue reading the pipes
+// It returns (nil, err) if the process died by itself
 // It returns (nil, nil) if the process exited normally without triggering an upgrade. This is very unlikely
 // to happend with "start" but may happend with short-lived commands like `gaiad export ...`
-func WaitForUpgradeOrExit(cmd *exec.Cmd, scanOut, scanErr *bufio.Scanner) (*UpgradeInfo, error) {
+func WaitForUpgradeOrExit(cmd *exec.Cmd, output *daemonOutput) (*UpgradeInfo, error) {
 	var res WaitResult
-
-	waitScan := func(scan *bufio.Scanner) {
-		upgrade, err := WaitForUpdate(scan)
-		if err != nil {
-			res.SetError(err)
-		} else if upgrade != nil {
-			res.SetUpgrade(upgrade)
-			// now we need to kill the process
-			_ = cmd.Process.Kill()
-		}
+	exited := waitExit(cmd)
+	select {
+	case <-output.found:
+		// now we need to kill the process
+		_ = killGroup(cmd)
+		<-exited
+	case err := <-exited:
+		// this will set the error code if it wasn't killed due to upgrade
+		res.SetError(err)
 	}
-
-	// wait for the scanners, which can trigger upgrade and kill cmd
-	go waitScan(scanOut)
-	go waitScan(scanErr)
-
-	// if the command exits normally (eg. short command like `gaiad version`), just return (nil, nil)
-	// we often get broken read pipes if it runs too fast.
-	// if we had upgrade info, we would have killed it, and thus got a non-nil error code
-	err := cmd.Wait()
-	if err == nil {
-		return nil, nil
+	output.flush()
+	// the daemon may also exit by itself after the upgrade message (the SDK panics)
+	for _, upgrade := range output.take() {
+		res.SetUpgrade(upgrade)
 	}
-	// this will set the error code if it wasn't killed due to upgrade
-	res.SetError(err)
 	return res.AsResult()
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PruneResult lists what Prune removed (or would remove on a dry run) and what it kept
+type PruneResult struct {
+	Removed []string
+	Kept    []string
+	// Reclaimed is the total size in bytes of the removed directories
+	Reclaimed int64
+	DryRun    bool
+}
+
+// Prune removes old upgrade directories. It always keeps the current version, the previous version
+// (to allow a rollback), the keep most recently used other versions, and anything pinned, either in
+// cfg.PinnedUpgrades or with a .pinned file in the upgrade directory. Versions that were never current
+// are kept as well, as they may be pending upgrades. Genesis is never touched.
+// With dryRun set, nothing is removed, but the result reports what would be.
+func Prune(cfg *Config, keep int, dryRun bool) (*PruneResult, error) {
+	if keep < 0 {
+		return nil, errors.New("number of versions to keep must not be negative")
+	}
+	// the links may be relative or go through other links, so compare the directories they resolve to
+	var linked []os.FileInfo
+	for _, link := range []string{currentLink, previousLink} {
+		if info, err := os.Stat(filepath.Join(cfg.Root(), link)); err == nil {
+			linked = append(linked, info)
+		}
+	}
+	protected := func(dir string) bool {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return false
+		}
+		for _, l := range linked {
+			if os.SameFile(l, info) {
+				return true
+			}
+		}
+		return false
+	}
+	pinned := map[string]bool{}
+	for _, name := range cfg.PinnedUpgrades {
+		pinned[cfg.UpgradeDir(name)] = true
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(cfg.Root(), upgradesDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "reading upgrades dir")
+	}
+
+	type candidate struct {
+		name      string
+		activated time.Time
+	}
+	res := &PruneResult{DryRun: dryRun}
+	var candidates []candidate
+	for _, entry := range entries {
+		// partial installs are left to the doctor, they may be in progress
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), stagingPrefix) {
+			continue
+		}
+		name, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			name = entry.Name()
+		}
+		dir := filepath.Join(cfg.Root(), upgradesDir, entry.Name())
+		activated, err := os.Stat(filepath.Join(dir, activatedFile))
+		_, pinErr := os.Stat(filepath.Join(dir, pinnedFile))
+		if protected(dir) || pinned[dir] || err != nil || pinErr == nil {
+			res.Kept = append(res.Kept, name)
+			continue
+		}
+		candidates = append(candidates, candidate{name: name, activated: activated.ModTime()})
+	}
+
+	// most recently used first, those are the ones we keep
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].activated.After(candidates[j].activated)
+	})
+	for i, c := range candidates {
+		if i < keep {
+			res.Kept = append(res.Kept, c.name)
+			continue
+		}
+		dir := cfg.UpgradeDir(c.name)
+		size, err := dirSize(dir)
+		if err != nil {
+			return res, err
+		}
+		if !dryRun {
+			if err := os.RemoveAll(dir); err != nil {
+				return res, errors.Wrapf(err, "removing %s", dir)
+			}
+		}
+		res.Removed = append(res.Removed, c.name)
+		res.Reclaimed += size
+	}
+	sort.Strings(res.Kept)
+	return res, nil
+}
+
+// dirSize sums up the size of all files under dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, errors.Wrapf(err, "measuring %s", dir)
+}
+
+// PruneCmd removes old upgrade directories: `--cosmosd-prune [-keep N] [-dry-run]`
+func PruneCmd(opts Options, args []string, stdout io.Writer) error {
+	cfg, err := GetConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet(commandPrefix+"prune", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	keep := flags.Int("keep", cfg.RetainUpgrades, "number of previously used versions to keep, besides current and previous")
+	dryRun := flags.Bool("dry-run", false, "only report what would be removed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// a running cosmosd prunes after upgrades itself, and switches current under our feet
+	if !*dryRun {
+		lock, err := cfg.Lock()
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+	res, err := Prune(cfg, *keep, *dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "Removed"
+	if res.DryRun {
+		verb = "Would remove"
+	}
+	for _, name := range res.Removed {
+		fmt.Fprintf(stdout, "%s %s\n", verb, cfg.UpgradeDir(name))
+	}
+	fmt.Fprintf(stdout, "Kept %d upgrade(s), %s %d upgrade(s) reclaiming %d bytes\n",
+		len(res.Kept), strings.ToLower(verb), len(res.Removed), res.Reclaimed)
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrune(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// install a few copies of chain2, and use all but pending in turn
+	for _, name := range []string{"old1", "old2", "old3", "pinned"} {
+		_, err := InstallUpgrade(cfg, name, cfg.UpgradeBin("chain2"), false)
+		require.NoError(t, err)
+	}
+	_, err = InstallUpgrade(cfg, "pending", cfg.UpgradeBin("chain2"), false)
+	require.NoError(t, err)
+	for _, name := range []string{"old1", "pinned", "old2", "old3", "chain2", "chain3"} {
+		require.NoError(t, cfg.SetCurrentUpgrade(name))
+		// make sure activation times differ
+		time.Sleep(10 * time.Millisecond)
+		require.NoError(t, os.Chtimes(filepath.Join(cfg.UpgradeDir(name), activatedFile), time.Now(), time.Now()))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.UpgradeDir("pinned"), pinnedFile), nil, 0644))
+
+	// keep one more than current (chain3) and previous (chain2): old3
+	res, err := Prune(cfg, 1, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old2", "old1"}, res.Removed)
+	assert.Equal(t, []string{"chain2", "chain3", "nobin", "noexec", "old3", "pending", "pinned"}, res.Kept)
+	assert.True(t, res.Reclaimed > 0)
+	// dry run leaves everything in place
+	for _, name := range res.Removed {
+		assert.NoError(t, EnsureBinary(cfg.UpgradeBin(name)))
+	}
+
+	// configured pins are respected too
+	cfg.PinnedUpgrades = []string{"old1"}
+	res, err = Prune(cfg, 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old3", "old2"}, res.Removed)
+	for _, name := range res.Removed {
+		_, err := os.Stat(cfg.UpgradeDir(name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+	require.NoError(t, EnsureBinary(cfg.UpgradeBin("old1")))
+	require.NoError(t, EnsureBinary(cfg.GenesisBin()))
+
+	// the layout still works
+	_, err = cfg.Rollback()
+	require.NoError(t, err)
+}
+
+func TestAutomaticPrune(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	os.Setenv("DAEMON_HOME", home)
+	os.Setenv("DAEMON_NAME", "dummyd")
+	os.Setenv("DAEMON_RETAIN_UPGRADES", "1")
+	defer os.Unsetenv("DAEMON_HOME")
+	defer os.Unsetenv("DAEMON_NAME")
+	defer os.Unsetenv("DAEMON_RETAIN_UPGRADES")
+
+	cfg, err := GetConfigFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, 1, cfg.RetainUpgrades)
+
+	for _, name := range []string{"old1", "old2"} {
+		_, err := InstallUpgrade(cfg, name, cfg.UpgradeBin("chain2"), false)
+		require.NoError(t, err)
+	}
+	for _, name := range []string{"old1", "old2", "chain2", "chain3"} {
+		require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: name}))
+		time.Sleep(10 * time.Millisecond)
+	}
+	// chain3 is current, chain2 previous and old2 is retained
+	_, err = os.Stat(cfg.UpgradeDir("old1"))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, EnsureBinary(cfg.UpgradeBin("old2")))
+
+	var out bytes.Buffer
+	require.NoError(t, RunCommand("prune", nil, []string{"-keep", "0", "-dry-run"}, &out))
+	assert.Contains(t, out.String(), "Would remove "+cfg.UpgradeDir("old2"))
+
+	os.Setenv("DAEMON_RETAIN_UPGRADES", "-1")
+	_, err = GetConfigFromEnv()
+	assert.Error(t, err)
+}
+
+func TestPruneRelativeLinks(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	for _, name := range []string{"chain2", "chain3"} {
+		require.NoError(t, cfg.SetCurrentUpgrade(name))
+	}
+	// links set up by hand, relative to upgrade_manager
+	for link, target := range map[string]string{currentLink: "upgrades/chain3", previousLink: "./upgrades/chain2"} {
+		path := filepath.Join(cfg.Root(), link)
+		require.NoError(t, os.Remove(path))
+		require.NoError(t, os.Symlink(target, path))
+	}
+
+	res, err := Prune(cfg, 0, false)
+	require.NoError(t, err)
+	assert.Empty(t, res.Removed)
+	assert.Contains(t, res.Kept, "chain2")
+	assert.Contains(t, res.Kept, "chain3")
+	require.NoError(t, EnsureBinary(cfg.UpgradeBin("chain3")))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// writeDaemonPid records the pid of the running daemon under upgrade_manager, with its start time
+// so a reused pid (eg. after a reboot) isn't mistaken for it
+func (cfg *Config) writeDaemonPid(pid int) error {
+	path := filepath.Join(cfg.Root(), daemonPidFile)
+	content := strconv.Itoa(pid)
+	if start, ok := processStartTime(pid); ok {
+		content += " " + start
+	}
+	return errors.Wrap(ioutil.WriteFile(path, []byte(content+"\n"), 0644), "writing daemon pid")
+}
+
+func (cfg *Config) removeDaemonPid() {
+	os.Remove(filepath.Join(cfg.Root(), daemonPidFile))
+}
+
+// RunningDaemon returns the pid of the daemon if one launched by cosmosd is still alive
+func (cfg *Config) RunningDaemon() (int, bool) {
+	bz, err := ioutil.ReadFile(filepath.Join(cfg.Root(), daemonPidFile))
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(bz))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	// a process started at another time only reuses the pid, the daemon is gone
+	if start, ok := processStartTime(pid); ok && len(fields) > 1 && start != fields[1] {
+		return 0, false
+	}
+	return pid, processAlive(pid)
+}
+
+// PreviousDir returns the version directory current pointed to before the last switch
+func (cfg *Config) PreviousDir() (string, error) {
+	link := filepath.Join(cfg.Root(), previousLink)
+	info, err := os.Lstat(link)
+	if err != nil {
+		return "", errors.Wrap(err, "no previous version recorded")
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return "", errors.Errorf("%s is not a symlink", link)
+	}
+	return os.Readlink(link)
+}
+
+// Rollback points current back to the previous version, and remembers the version we roll back from
+// as previous (so a second rollback undoes the first). It refuses to run while a cosmosd supervises the
+// directory or the daemon is alive, and returns the version directory that is now current.
+func (cfg *Config) Rollback() (string, error) {
+	lock, err := cfg.Lock()
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+	if pid, ok := cfg.RunningDaemon(); ok {
+		return "", errors.Errorf("daemon is still running (pid %d), stop it before rolling back", pid)
+	}
+	prev, err := cfg.PreviousDir()
+	if err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	cur, _ := cfg.CurrentDir()
+	err = cfg.checkBinary(filepath.Join(prev, "bin", cfg.Name))
+	if err != nil {
+		err = errors.Wrap(err, "previous version has no valid binary")
+	} else {
+		err = cfg.switchCurrent(prev)
+	}
+	cfg.appendHistory(HistoryRecord{Event: EventRollback, OldTarget: cur, NewTarget: prev}, start, err)
+	if err != nil {
+		return "", err
+	}
+	logger.Info("rolled back", "from", cur, "to", prev)
+	cfg.notify(Notification{Event: NotifyRollback, Target: prev, Message: "rolled back from " + cur}, nil)
+	return prev, nil
+}
+
+// RollbackCmd switches current back to the previous version: `--cosmosd-rollback`
+func RollbackCmd(opts Options, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(commandPrefix+"rollback", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := GetConfig(opts)
+	if err != nil {
+		return err
+	}
+	dir, err := cfg.Rollback()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Rolled back, current now points to %s\n", dir)
+	return nil
+}
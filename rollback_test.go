@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollback(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// nothing to roll back to yet
+	_, err = cfg.Rollback()
+	require.Error(t, err)
+
+	_, err = cfg.CurrentBin()
+	require.NoError(t, err)
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2"}))
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain3"}))
+
+	// rolling back twice returns to where we started
+	dir, err := cfg.Rollback()
+	require.NoError(t, err)
+	assert.Equal(t, cfg.UpgradeDir("chain2"), dir)
+	assertCurrentLink(t, *cfg, "upgrades/chain2")
+
+	_, err = cfg.Rollback()
+	require.NoError(t, err)
+	assertCurrentLink(t, *cfg, "upgrades/chain3")
+
+	// switching to the same version again doesn't lose the previous one
+	require.NoError(t, cfg.SetCurrentUpgrade("chain3"))
+	prev, err := cfg.PreviousDir()
+	require.NoError(t, err)
+	assert.Equal(t, cfg.UpgradeDir("chain2"), prev)
+
+	// refuse while the daemon is alive (pretend we are the daemon)
+	require.NoError(t, cfg.writeDaemonPid(os.Getpid()))
+	_, err = cfg.Rollback()
+	require.Error(t, err)
+	assertCurrentLink(t, *cfg, "upgrades/chain3")
+
+	cfg.removeDaemonPid()
+	_, ok := cfg.RunningDaemon()
+	assert.False(t, ok)
+}
+
+func TestRollbackToGenesis(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	os.Setenv("DAEMON_HOME", home)
+	os.Setenv("DAEMON_NAME", "dummyd")
+	defer os.Unsetenv("DAEMON_HOME")
+	defer os.Unsetenv("DAEMON_NAME")
+
+	// launching the genesis binary performs the upgrade to chain2
+	var stdout, stderr bytes.Buffer
+	doUpgrade, err := LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	require.True(t, doUpgrade)
+	_, ok := cfg.RunningDaemon()
+	assert.False(t, ok)
+
+	var out bytes.Buffer
+	require.NoError(t, RunCommand("rollback", nil, nil, &out))
+	assert.Contains(t, out.String(), cfg.GenesisDir())
+	assertCurrentLink(t, *cfg, "genesis")
+}
@@ -21,11 +21,11 @@ var upgradeRegex = regexp.MustCompile(`UPGRADE "(.*)" NEEDED at ((height): (\d+)
 
 // UpgradeInfo is the details from the regexp
 type UpgradeInfo struct {
-	Name string
+	Name string `json:"name"`
 	// Only 1 of Height or Time is non-zero value
-	Height int
-	Time   string
-	Info   string
+	Height int    `json:"height,omitempty"`
+	Time   string `json:"time,omitempty"`
+	Info   string `json:"info,omitempty"`
 }
 
 // WaitForUpdate will listen to the scanner until a line matches upgradeRegexp.
@@ -35,27 +35,37 @@ type UpgradeInfo struct {
 func WaitForUpdate(scanner *bufio.Scanner) (*UpgradeInfo, error) {
 	for scanner.Scan() {
 		line := scanner.Text()
-		if upgradeRegex.MatchString(line) {
-			subs := upgradeRegex.FindStringSubmatch(line)
-			info := UpgradeInfo{
-				Name: subs[1],
-				Info: subs[7],
-			}
-			var err error
-			if subs[3] != "" {
-				// match height
-				info.Height, err = strconv.Atoi(subs[4])
-				if err != nil {
-					return nil, errors.Wrap(err, "parse number from regexp")
-				}
-			} else if subs[5] != "" {
-				// match time
-				// TODO: parse time
-				info.Time = subs[6]
-
-			}
-			return &info, nil
+		metrics.ObserveLine(line)
+		info, err := ParseUpgrade(line)
+		if info != nil || err != nil {
+			return info, err
 		}
 	}
 	return nil, scanner.Err()
 }
+
+// ParseUpgrade returns the upgrade info if line matches upgradeRegexp, nil otherwise
+func ParseUpgrade(line string) (*UpgradeInfo, error) {
+	subs := upgradeRegex.FindStringSubmatch(line)
+	if subs == nil {
+		return nil, nil
+	}
+	info := UpgradeInfo{
+		Name: subs[1],
+		Info: subs[7],
+	}
+	var err error
+	if subs[3] != "" {
+		// match height
+		info.Height, err = strconv.Atoi(subs[4])
+		if err != nil {
+			return nil, errors.Wrap(err, "parse number from regexp")
+		}
+	} else if subs[5] != "" {
+		// match time
+		// TODO: parse time
+		info.Time = subs[6]
+
+	}
+	return &info, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// systemd passes these to services with Type=notify (and WatchdogSec= for the watchdog)
+const (
+	notifySocketEnv = "NOTIFY_SOCKET"
+	watchdogUsecEnv = "WATCHDOG_USEC"
+	watchdogPidEnv  = "WATCHDOG_PID"
+)
+
+// SdNotify sends the state (eg. READY=1, STATUS=..., WATCHDOG=1, one per line) to systemd.
+// It does nothing when not started by systemd with Type=notify.
+func SdNotify(state string) error {
+	name := os.Getenv(notifySocketEnv)
+	if name == "" {
+		return nil
+	}
+	// abstract socket
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "connecting to systemd")
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return errors.Wrap(err, "notifying systemd")
+	}
+	return nil
+}
+
+// notifySystemd is SdNotify for events that must not fail because systemd didn't listen
+func notifySystemd(state string) {
+	if err := SdNotify(state); err != nil {
+		logger.Warn("notifying systemd failed", "state", state, "error", err)
+	}
+}
+
+// notifyStatus shows status in `systemctl status`
+func notifyStatus(status string) {
+	notifySystemd("STATUS=" + status)
+}
+
+// watchdogInterval returns how often to ping the systemd watchdog, or 0 if it is not enabled for us
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv(watchdogUsecEnv), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv(watchdogPidEnv); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	// ping twice per timeout, as recommended by sd_watchdog_enabled(3)
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// startWatchdog pings the systemd watchdog until the returned function is called.
+// It is started while the daemon is running, so systemd detects a wedged upgrade manager.
+func startWatchdog() func() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return func() {}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			notifySystemd("WATCHDOG=1")
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
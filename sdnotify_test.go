@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenNotify plays systemd, returning all states received on NOTIFY_SOCKET once done is called
+func listenNotify(t *testing.T) (done func() []string) {
+	dir, err := ioutil.TempDir("", "sd-notify")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	os.Setenv(notifySocketEnv, path)
+
+	states := make(chan []string)
+	go func() {
+		var received []string
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				states <- received
+				return
+			}
+			received = append(received, string(buf[:n]))
+		}
+	}()
+	return func() []string {
+		os.Unsetenv(notifySocketEnv)
+		conn.Close()
+		defer os.RemoveAll(dir)
+		return <-states
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	// nothing to do without systemd
+	require.NoError(t, SdNotify("READY=1"))
+
+	done := listenNotify(t)
+	require.NoError(t, SdNotify("STATUS=testing"))
+	require.NoError(t, SdNotify("READY=1"))
+	// give the datagrams time to arrive
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"STATUS=testing", "READY=1"}, done())
+
+	os.Setenv(notifySocketEnv, "/non/existing/notify.sock")
+	defer os.Unsetenv(notifySocketEnv)
+	require.Error(t, SdNotify("READY=1"))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv(watchdogUsecEnv)
+	defer os.Unsetenv(watchdogPidEnv)
+
+	assert.Equal(t, time.Duration(0), watchdogInterval())
+	os.Setenv(watchdogUsecEnv, "30000000")
+	assert.Equal(t, 15*time.Second, watchdogInterval())
+	os.Setenv(watchdogPidEnv, strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 15*time.Second, watchdogInterval())
+	// meant for another process
+	os.Setenv(watchdogPidEnv, "1")
+	assert.Equal(t, time.Duration(0), watchdogInterval())
+}
+
+func TestLaunchProcessNotifiesSystemd(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	os.Setenv(watchdogUsecEnv, "200000")
+	defer os.Unsetenv(watchdogUsecEnv)
+	done := listenNotify(t)
+
+	// genesis runs for a second before the upgrade is detected
+	var stdout, stderr bytes.Buffer
+	doUpgrade, err := LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	require.True(t, doUpgrade)
+	time.Sleep(50 * time.Millisecond)
+	states := done()
+
+	require.NotEmpty(t, states)
+	assert.Equal(t, "READY=1\nSTATUS=running genesis", states[0])
+	watchdog := 0
+	for _, s := range states {
+		if s == "WATCHDOG=1" {
+			watchdog++
+		}
+	}
+	assert.True(t, watchdog >= 5, "%d watchdog pings", watchdog)
+	// the watchdog stops with the daemon, before the upgrade
+	assert.Equal(t, []string{"STATUS=upgrade chain2 detected, daemon stopped", "STATUS=switching to chain2"}, states[len(states)-2:])
+}
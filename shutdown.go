@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// groupExitTimeout bounds how long we wait for leftover processes of the daemon to die
+	groupExitTimeout = 5 * time.Second
+	// portFreeTimeout bounds how long we wait for the daemon ports to be released
+	portFreeTimeout = 10 * time.Second
+	pollInterval    = 50 * time.Millisecond
+	// outputGracePeriod is how long we keep reading the output of the daemon after it exited, processes
+	// it started may hold on to it
+	outputGracePeriod = 2 * time.Second
+	// daemonStopTimeout bounds how long the daemon may take to exit after we passed it SIGINT or SIGTERM
+	daemonStopTimeout = 30 * time.Second
+)
+
+// daemonGroup is the process group of the running daemon
+var daemonGroup = &processGroup{}
+
+// processGroup passes the SIGINT and SIGTERM we receive on to the daemon: it runs in its own group, so
+// it doesn't get them from the terminal, and systemd only signals us. Once a signal arrived, no new daemon
+// is started.
+type processGroup struct {
+	mutex  sync.Mutex
+	pgid   int
+	signal os.Signal
+}
+
+// started records the group of a new daemon, and stops it right away if we are already stopping
+func (g *processGroup) started(pgid int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.pgid = pgid
+	if g.signal != nil {
+		g.stop()
+	}
+}
+
+// exited forgets the group once the daemon and all its processes are gone
+func (g *processGroup) exited() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.pgid = 0
+}
+
+// forward passes sig on to the daemon group
+func (g *processGroup) forward(sig os.Signal) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.signal = sig
+	if g.pgid != 0 {
+		g.stop()
+	}
+}
+
+// stopping returns the signal we received, if any
+func (g *processGroup) stopping() os.Signal {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.signal
+}
+
+// stop signals the group, and kills it if it is still there after daemonStopTimeout. The caller holds the mutex.
+func (g *processGroup) stop() {
+	pgid := g.pgid
+	sig, ok := g.signal.(syscall.Signal)
+	if !ok {
+		sig = syscall.SIGTERM
+	}
+	if err := syscall.Kill(-pgid, sig); err != nil && err != syscall.ESRCH {
+		logger.Warn("signaling the daemon failed", "pgid", pgid, "error", err)
+	}
+	time.AfterFunc(daemonStopTimeout, func() {
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		if g.pgid == pgid {
+			logger.Warn("daemon did not stop in time, killing it", "pgid", pgid, "timeout", daemonStopTimeout)
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		}
+	})
+}
+
+// checkNoLeftoverDaemon refuses to start a daemon while the one recorded in daemon.pid (or anything it
+// started) is still running, eg. after cosmosd itself was killed
+func (cfg *Config) checkNoLeftoverDaemon() error {
+	pid, _ := cfg.RunningDaemon()
+	if pid == 0 || !groupAlive(pid) {
+		return nil
+	}
+	return errors.Errorf("the daemon started by a previous cosmosd (process group %d, see %s) is still running, stop it first",
+		pid, daemonPidFile)
+}
+
+// startInGroup makes the daemon the leader of a new process group, so signals reach everything it started
+// (eg. when it is a shell wrapper around the real node)
+func startInGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killGroup kills the daemon and every process it started
+func killGroup(cmd *exec.Cmd) error {
+	// the group id is the pid of its leader, a negative pid signals the whole group
+	err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+// ensureGroupGone makes sure no process of the daemon group outlives the daemon, as it might still be
+// signing blocks. Leftovers are killed, and it is an error if they don't die within groupExitTimeout.
+func ensureGroupGone(pgid int) error {
+	if !groupAlive(pgid) {
+		return nil
+	}
+	logger.Warn("killing leftover processes of the daemon", "pgid", pgid)
+	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return errors.Wrapf(err, "killing process group %d", pgid)
+	}
+	for deadline := time.Now().Add(groupExitTimeout); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		if !groupAlive(pgid) {
+			return nil
+		}
+	}
+	return errors.Errorf("processes of the previous daemon (process group %d) are still running", pgid)
+}
+
+func groupAlive(pgid int) bool {
+	// if we ended up as their parent (eg. as pid 1 in a container), reap them, zombies count as alive
+	for {
+		pid, err := syscall.Wait4(-pgid, nil, syscall.WNOHANG, nil)
+		if err != nil || pid <= 0 {
+			break
+		}
+	}
+	err := syscall.Kill(-pgid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// checkPortsFree waits up to portFreeTimeout for the configured daemon ports to be free,
+// so we never start a node while another one still listens
+func (cfg *Config) checkPortsFree() error {
+	for _, port := range cfg.CheckPorts {
+		addr := listenAddr(port)
+		deadline := time.Now().Add(portFreeTimeout)
+		for {
+			err := portFree(addr)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return errors.Wrapf(err, "port %s is still in use, is another daemon running?", port)
+			}
+			time.Sleep(pollInterval)
+		}
+	}
+	return nil
+}
+
+// listenAddr turns the ways ports are written in the node config (26656, :26656, tcp://0.0.0.0:26656)
+// into an address to listen on
+func listenAddr(port string) string {
+	if i := strings.Index(port, "://"); i >= 0 {
+		port = port[i+3:]
+	}
+	if !strings.Contains(port, ":") {
+		port = ":" + port
+	}
+	return port
+}
+
+func portFree(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
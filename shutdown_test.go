@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLaunchProcessKillsGroup(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// a shell wrapper starting the real node in the background
+	wrapper := "#!/bin/sh\nsleep 30 >/dev/null 2>&1 &\necho node $!\nsleep 1\necho 'UPGRADE \"chain2\" NEEDED at height: 49: {}'\nsleep 30\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(wrapper), 0755))
+
+	var stdout, stderr bytes.Buffer
+	start := time.Now()
+	doUpgrade, err := LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	require.True(t, doUpgrade)
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	fields := strings.Fields(strings.SplitN(stdout.String(), "\n", 2)[0])
+	require.Len(t, fields, 2)
+	node, err := strconv.Atoi(fields[1])
+	require.NoError(t, err)
+	// the background node died with the wrapper (a zombie until it is reaped doesn't count)
+	err = syscall.Kill(node, 0)
+	if err == nil {
+		bz, _ := ioutil.ReadFile(filepath.Join("/proc", fields[1], "stat"))
+		assert.Contains(t, string(bz), ") Z ", "node %d is still running", node)
+	}
+}
+
+func TestLaunchProcessOutputHeldOpen(t *testing.T) {
+	defer func(d time.Duration) { outputGracePeriod = d }(outputGracePeriod)
+	outputGracePeriod = 200 * time.Millisecond
+
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// the daemon exits, but a process it started still holds its output
+	wrapper := "#!/bin/sh\nsleep 30 &\necho started $$\nexit 3\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(wrapper), 0755))
+
+	var stdout, stderr syncBuffer
+	done := make(chan error)
+	go func() {
+		_, err := LaunchProcess(cfg, nil, &stdout, &stderr)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("LaunchProcess blocked after the daemon exited")
+	}
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exit status 3")
+
+	fields := strings.Fields(stdout.String())
+	require.Len(t, fields, 2)
+	assert.Equal(t, "started", fields[0])
+	// the group of the daemon is gone, including the process holding the output
+	pgid, err := strconv.Atoi(fields[1])
+	require.NoError(t, err)
+	assert.False(t, groupAlive(pgid))
+	_, ok := cfg.RunningDaemon()
+	assert.False(t, ok)
+}
+
+func TestEnsureGroupGone(t *testing.T) {
+	// nothing left
+	require.NoError(t, ensureGroupGone(deadPid(t)))
+}
+
+func TestCheckPortsFree(t *testing.T) {
+	defer func(d time.Duration) { portFreeTimeout = d }(portFreeTimeout)
+	portFreeTimeout = 100 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	for _, p := range []string{port, "127.0.0.1:" + port, "tcp://127.0.0.1:" + port} {
+		cfg := &Config{CheckPorts: []string{p}}
+		err = cfg.checkPortsFree()
+		require.Error(t, err, p)
+		assert.Contains(t, err.Error(), "is still in use")
+	}
+
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", CheckPorts: []string{port}}
+	var stdout, stderr bytes.Buffer
+	_, err = LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.Error(t, err)
+	assert.Empty(t, stdout.String())
+
+	// free once the old node is gone
+	require.NoError(t, l.Close())
+	require.NoError(t, cfg.checkPortsFree())
+}
+
+func TestLaunchProcessForwardsSignals(t *testing.T) {
+	defer func(g *processGroup) { daemonGroup = g }(daemonGroup)
+	daemonGroup = &processGroup{}
+
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	hook := &webhookRecorder{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	cfg := &Config{Home: home, Name: "dummyd", WebhookURLs: []string{server.URL}}
+
+	// a node shutting down cleanly on SIGTERM, with a child of its own
+	daemon := "#!/bin/sh\nsleep 30 &\ntrap 'echo stopping; exit 0' TERM\necho up\nwhile true; do sleep 0.1; done\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(daemon), 0755))
+
+	var stdout, stderr syncBuffer
+	done := make(chan error)
+	go func() {
+		_, err := LaunchProcess(cfg, nil, &stdout, &stderr)
+		done <- err
+	}()
+	for i := 0; i < 100 && !strings.Contains(stdout.String(), "up"); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	pid, ok := cfg.RunningDaemon()
+	require.True(t, ok)
+
+	daemonGroup.forward(syscall.SIGTERM)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon did not stop")
+	}
+	assert.Equal(t, "up\nstopping\n", stdout.String())
+	assert.False(t, groupAlive(pid))
+	assert.Equal(t, syscall.SIGTERM, daemonGroup.stopping())
+
+	// once stopping, a new daemon is stopped right away (Run doesn't report its exit as a failure)
+	start := time.Now()
+	doUpgrade, _ := LaunchProcess(cfg, nil, &stdout, &stderr)
+	assert.False(t, doUpgrade)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	// neither stop is reported as a crash
+	require.True(t, FlushNotifications(5*time.Second))
+	assert.Empty(t, hook.events())
+}
+
+func TestLaunchProcessRefusesLeftoverDaemon(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// the daemon of a cosmosd that was killed
+	leftover := exec.Command("sleep", "30")
+	startInGroup(leftover)
+	require.NoError(t, leftover.Start())
+	require.NoError(t, cfg.writeDaemonPid(leftover.Process.Pid))
+
+	var stdout, stderr bytes.Buffer
+	_, err = LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "still running")
+	assert.Empty(t, stdout.String())
+
+	require.NoError(t, killGroup(leftover))
+	_ = leftover.Wait()
+	doUpgrade, err := LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.True(t, doUpgrade)
+}
+
+func TestLaunchProcessIgnoresStaleDaemonPid(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// after a reboot, the recorded pid belongs to an unrelated process group
+	unrelated := exec.Command("sleep", "30")
+	startInGroup(unrelated)
+	require.NoError(t, unrelated.Start())
+	defer func() {
+		_ = killGroup(unrelated)
+		_ = unrelated.Wait()
+	}()
+	stale := fmt.Sprintf("%d 00000000-0000-0000-0000-000000000000/1\n", unrelated.Process.Pid)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.Root(), daemonPidFile), []byte(stale), 0644))
+	_, ok := cfg.RunningDaemon()
+	assert.False(t, ok)
+
+	var stdout, stderr bytes.Buffer
+	doUpgrade, err := LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.True(t, doUpgrade)
+	assert.True(t, processAlive(unrelated.Process.Pid))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// sidecarsFile under upgrade_manager lists the sidecars of every version, the same file in a version
+// directory adds or replaces sidecars for that version only
+const sidecarsFile = "sidecars.yaml"
+
+// sidecarStopTimeout bounds how long a sidecar may take to exit after SIGTERM
+var sidecarStopTimeout = 10 * time.Second
+
+// Sidecar is a companion process of the daemon (eg. a price feeder or a relayer), started along with it
+type Sidecar struct {
+	Name string `yaml:"name"`
+	// Command is the program and its arguments, a relative program path (eg. bin/feeder) is resolved against
+	// the version directory, which is also the working directory
+	Command []string `yaml:"command"`
+	// Env holds KEY=VALUE pairs added to the environment of the sidecar, on top of that of the daemon
+	Env []string `yaml:"env"`
+}
+
+// VersionSidecars returns the sidecars to run along with the version directory dir: those listed in
+// upgrade_manager/sidecars.yaml, with the ones in dir/sidecars.yaml added or replacing them by name
+func (cfg *Config) VersionSidecars(dir string) ([]Sidecar, error) {
+	sidecars, err := readSidecars(filepath.Join(cfg.Root(), sidecarsFile))
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := readSidecars(filepath.Join(dir, sidecarsFile))
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range overrides {
+		replaced := false
+		for i := range sidecars {
+			if sidecars[i].Name == o.Name {
+				sidecars[i], replaced = o, true
+			}
+		}
+		if !replaced {
+			sidecars = append(sidecars, o)
+		}
+	}
+	return sidecars, nil
+}
+
+// readSidecars parses a sidecars file, a missing file means no sidecars
+func readSidecars(path string) ([]Sidecar, error) {
+	bz, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading sidecars file")
+	}
+	var sidecars []Sidecar
+	if err := yaml.UnmarshalStrict(bz, &sidecars); err != nil {
+		return nil, errors.Wrapf(err, "parsing sidecars file %s", path)
+	}
+	names := map[string]bool{}
+	for _, sc := range sidecars {
+		switch {
+		case sc.Name == "":
+			return nil, errors.Errorf("sidecar without name in %s", path)
+		case names[sc.Name]:
+			return nil, errors.Errorf("duplicate sidecar %s in %s", sc.Name, path)
+		case len(sc.Command) == 0:
+			return nil, errors.Errorf("sidecar %s in %s has no command", sc.Name, path)
+		}
+		for _, kv := range sc.Env {
+			if strings.Index(kv, "=") <= 0 {
+				return nil, errors.Errorf("sidecar %s in %s: expected KEY=VALUE in env, got %q", sc.Name, path, kv)
+			}
+		}
+		names[sc.Name] = true
+	}
+	return sidecars, nil
+}
+
+// Sidecars are the running sidecars of one daemon
+type Sidecars struct {
+	stop    chan struct{}
+	running sync.WaitGroup
+}
+
+// StartSidecars starts the sidecars from the version directory dir, with the environment env of the daemon.
+// Their output is copied to stdout and stderr (shared with the daemon), every line prefixed with the sidecar name.
+// A sidecar that fails is restarted until Stop is called, one that exits successfully is done.
+func StartSidecars(sidecars []Sidecar, dir string, env []string, stdout, stderr *lineWriter) *Sidecars {
+	s := &Sidecars{stop: make(chan struct{})}
+	for _, sc := range sidecars {
+		s.running.Add(1)
+		go func(sc Sidecar) {
+			defer s.running.Done()
+			superviseSidecar(sc, dir, env, stdout, stderr, s.stop)
+		}(sc)
+	}
+	return s
+}
+
+// Stop stops all sidecars and waits for them to exit
+func (s *Sidecars) Stop() {
+	close(s.stop)
+	s.running.Wait()
+}
+
+func superviseSidecar(sc Sidecar, dir string, env []string, stdout, stderr *lineWriter, stop <-chan struct{}) {
+	backoff := restartBackoff
+	for {
+		start := time.Now()
+		err := runSidecar(sc, dir, env, stdout, stderr, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err == nil {
+			logger.Info("sidecar exited", "sidecar", sc.Name)
+			return
+		}
+		if time.Since(start) > maxRestartBackoff {
+			backoff = restartBackoff
+		}
+		logger.Warn("sidecar failed, restarting", "sidecar", sc.Name, "error", err, "delay", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return
+		}
+		if backoff *= 2; backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+// runSidecar runs the sidecar until it exits, or stops it once stop is closed
+func runSidecar(sc Sidecar, dir string, env []string, stdout, stderr *lineWriter, stop <-chan struct{}) error {
+	program := sc.Command[0]
+	if strings.Contains(program, "/") && !filepath.IsAbs(program) {
+		program = filepath.Join(dir, program)
+	}
+	cmd := exec.Command(program, sc.Command[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append([]string{}, env...)
+	for _, kv := range sc.Env {
+		i := strings.Index(kv, "=")
+		cmd.Env = setEnv(cmd.Env, kv[:i], kv[i+1:])
+	}
+	exited, err := startPrefixed(cmd, "["+sc.Name+"] ", stdout, stderr)
+	if err != nil {
+		return errors.Wrapf(err, "starting sidecar %s", sc.Name)
+	}
+	logger.Info("sidecar started", "sidecar", sc.Name, "bin", program, "pid", cmd.Process.Pid)
+
+	select {
+	case err := <-exited:
+		return err
+	case <-stop:
+	}
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(sidecarStopTimeout):
+	}
+	logger.Warn("sidecar did not stop in time, killing it", "sidecar", sc.Name, "timeout", sidecarStopTimeout)
+	_ = killGroup(cmd)
+	return <-exited
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionSidecars(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	sidecars, err := cfg.VersionSidecars(cfg.GenesisDir())
+	require.NoError(t, err)
+	assert.Empty(t, sidecars)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.Root(), sidecarsFile), []byte(`
+- name: feeder
+  command: [bin/feeder, start]
+  env: [FEEDER_HOME=/tmp]
+- name: backup
+  command: [/usr/local/bin/backup.sh]
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.UpgradeDir("chain2"), sidecarsFile), []byte(`
+- name: feeder
+  command: [bin/feeder-v2]
+- name: relayer
+  command: [rly, start]
+`), 0644))
+
+	sidecars, err = cfg.VersionSidecars(cfg.GenesisDir())
+	require.NoError(t, err)
+	assert.Equal(t, []Sidecar{
+		{Name: "feeder", Command: []string{"bin/feeder", "start"}, Env: []string{"FEEDER_HOME=/tmp"}},
+		{Name: "backup", Command: []string{"/usr/local/bin/backup.sh"}},
+	}, sidecars)
+
+	sidecars, err = cfg.VersionSidecars(cfg.UpgradeDir("chain2"))
+	require.NoError(t, err)
+	assert.Equal(t, []Sidecar{
+		{Name: "feeder", Command: []string{"bin/feeder-v2"}},
+		{Name: "backup", Command: []string{"/usr/local/bin/backup.sh"}},
+		{Name: "relayer", Command: []string{"rly", "start"}},
+	}, sidecars)
+
+	invalid := map[string]string{
+		"without name":        "- command: [a]\n",
+		"duplicate":           "- name: a\n  command: [a]\n- name: a\n  command: [b]\n",
+		"no command":          "- name: a\n",
+		"expected KEY":        "- name: a\n  command: [a]\n  env: [NOVALUE]\n",
+		"field cmd not found": "- name: a\n  cmd: [a]\n",
+	}
+	for msg, content := range invalid {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.Root(), sidecarsFile), []byte(content), 0644))
+		_, err := cfg.VersionSidecars(cfg.GenesisDir())
+		if assert.Error(t, err, msg) {
+			assert.Contains(t, err.Error(), msg)
+		}
+	}
+}
+
+func TestLaunchProcessWithSidecars(t *testing.T) {
+	defer func(backoff time.Duration) { restartBackoff = backoff }(restartBackoff)
+	restartBackoff = 10 * time.Millisecond
+
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// every version ships its own feeder, which runs until stopped and records its pid
+	pidFile := filepath.Join(home, "feeder.pid")
+	for _, dir := range []string{cfg.GenesisDir(), cfg.UpgradeDir("chain2")} {
+		script := "#!/bin/sh\necho $$ > " + pidFile + "\necho feeder " + filepath.Base(dir) + " $FEEDER_MODE\nexec sleep 30\n"
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bin", "feeder"), []byte(script), 0755))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.Root(), sidecarsFile), []byte(`
+- name: feeder
+  command: [bin/feeder]
+  env: [FEEDER_MODE=live]
+- name: flaky
+  command: [sh, -c, "echo flaky; exit 1"]
+- name: once
+  command: [sh, -c, "echo once"]
+`), 0644))
+
+	var stdout, stderr syncBuffer
+	doUpgrade, err := LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.True(t, doUpgrade)
+	out := stdout.String()
+	assert.Contains(t, out, "[feeder] feeder genesis live\n")
+	// failing sidecars are restarted, successful ones are done
+	assert.True(t, strings.Count(out, "[flaky] flaky\n") > 1, out)
+	assert.Equal(t, 1, strings.Count(out, "[once] once\n"), out)
+	// the feeder was stopped before the upgrade
+	assertStopped(t, pidFile)
+
+	stdout.buf.Reset()
+	_, err = LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Contains(t, stdout.String(), "[feeder] feeder chain2 live\n")
+	assertStopped(t, pidFile)
+}
+
+// exclusiveWriter records the lines written to it, and counts the writes overlapping another one
+type exclusiveWriter struct {
+	writing  int32
+	overlaps int32
+	lines    []string
+}
+
+func (w *exclusiveWriter) Write(p []byte) (int, error) {
+	if atomic.AddInt32(&w.writing, 1) > 1 {
+		atomic.AddInt32(&w.overlaps, 1)
+	}
+	defer atomic.AddInt32(&w.writing, -1)
+	time.Sleep(time.Millisecond)
+	w.lines = append(w.lines, string(p))
+	return len(p), nil
+}
+
+func TestLaunchProcessSharesOutputWithSidecars(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// the daemon and a sidecar both write lines in small pieces
+	chatty := "#!/bin/sh\nfor i in 1 2 3 4 5 6 7 8 9 10; do printf 'node '; printf 'line\\n'; done\nsleep 0.2\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(chatty), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.Root(), sidecarsFile), []byte(`
+- name: chatty
+  command: [sh, -c, "for i in 1 2 3 4 5 6 7 8 9 10; do printf 'side '; printf 'line\\n'; done"]
+`), 0644))
+
+	var stdout exclusiveWriter
+	var stderr syncBuffer
+	_, err = LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Zero(t, atomic.LoadInt32(&stdout.overlaps))
+	assert.Equal(t, 10, strings.Count(strings.Join(stdout.lines, ""), "[chatty] side line\n"))
+	assert.Equal(t, 10, strings.Count(strings.Join(stdout.lines, ""), "node line\n"))
+	for _, line := range stdout.lines {
+		assert.True(t, line == "node line\n" || line == "[chatty] side line\n", line)
+	}
+}
+
+func assertStopped(t *testing.T, pidFile string) {
+	bz, err := ioutil.ReadFile(pidFile)
+	require.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bz)))
+	require.NoError(t, err)
+	assert.False(t, processAlive(pid), "sidecar %d still running", pid)
+	require.NoError(t, os.Remove(pidFile))
+}
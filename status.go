@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Status is a read-only snapshot of the upgrade_manager layout
+type Status struct {
+	// CurrentBin is the binary that would be launched, empty if current is not linked yet
+	CurrentBin  string          `json:"current_bin"`
+	Genesis     VersionStatus   `json:"genesis"`
+	Upgrades    []VersionStatus `json:"upgrades"`
+	LastUpgrade *HistoryRecord  `json:"last_upgrade"`
+}
+
+// VersionStatus describes one version directory (genesis or an upgrade)
+type VersionStatus struct {
+	Name    string `json:"name"`
+	Bin     string `json:"bin"`
+	Valid   bool   `json:"valid"`
+	Error   string `json:"error,omitempty"`
+	Current bool   `json:"current"`
+}
+
+// GetStatus inspects the layout without modifying it (unlike CurrentBin, it never creates the current link)
+func GetStatus(cfg *Config) (*Status, error) {
+	var status Status
+	currentDir, err := cfg.CurrentDir()
+	if err == nil {
+		status.CurrentBin = filepath.Join(currentDir, "bin", cfg.Name)
+	}
+
+	status.Genesis = cfg.versionStatus(genesisDir, cfg.GenesisBin(), status.CurrentBin)
+
+	entries, err := ioutil.ReadDir(filepath.Join(cfg.Root(), upgradesDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "reading upgrades dir")
+	}
+	for _, entry := range entries {
+		// skip files and partial installs
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), stagingPrefix) {
+			continue
+		}
+		// directory names are escaped, report the real upgrade name
+		name, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			name = entry.Name()
+		}
+		status.Upgrades = append(status.Upgrades, cfg.versionStatus(name, cfg.UpgradeBin(name), status.CurrentBin))
+	}
+
+	status.LastUpgrade, err = cfg.LastUpgrade()
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// versionStatus checks bin the way the launcher does, see checkBinary
+func (cfg *Config) versionStatus(name, bin, currentBin string) VersionStatus {
+	v := VersionStatus{
+		Name:    name,
+		Bin:     bin,
+		Current: bin == currentBin,
+	}
+	if err := cfg.checkBinary(bin); err != nil {
+		v.Error = err.Error()
+	} else {
+		v.Valid = true
+	}
+	return v
+}
+
+// StatusCmd prints the status of the upgrade_manager layout as a table, or as json with -json
+func StatusCmd(opts Options, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(commandPrefix+"status", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	asJSON := flags.Bool("json", false, "print status as json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := GetConfig(opts)
+	if err != nil {
+		return err
+	}
+	status, err := GetStatus(cfg)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(status)
+	}
+	return status.WriteTable(stdout)
+}
+
+// WriteTable prints the status in a human readable form
+func (s *Status) WriteTable(w io.Writer) error {
+	current := s.CurrentBin
+	if current == "" {
+		current = "(not linked, genesis will be used)"
+	}
+	fmt.Fprintf(w, "Current binary: %s\n", current)
+	if s.LastUpgrade == nil {
+		fmt.Fprintf(w, "Last upgrade:   (none)\n\n")
+	} else {
+		fmt.Fprintf(w, "Last upgrade:   %s at %s\n\n", s.LastUpgrade.Upgrade.Name, s.LastUpgrade.Time.Format(time.RFC3339))
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tNAME\tVALID\tBINARY\tERROR")
+	for _, v := range append([]VersionStatus{s.Genesis}, s.Upgrades...) {
+		marker := ""
+		if v.Current {
+			marker = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\n", marker, v.Name, v.Valid, v.Bin, v.Error)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetStatus(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// nothing linked yet, and status must not create the link
+	status, err := GetStatus(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "", status.CurrentBin)
+	assert.Nil(t, status.LastUpgrade)
+	assert.True(t, status.Genesis.Valid)
+	assert.False(t, status.Genesis.Current)
+	_, err = cfg.CurrentDir()
+	require.Error(t, err)
+
+	valid := map[string]bool{}
+	for _, v := range status.Upgrades {
+		valid[v.Name] = v.Valid
+	}
+	assert.Equal(t, map[string]bool{"chain2": true, "chain3": true, "nobin": false, "noexec": false}, valid)
+
+	// after an upgrade we see the new current binary and the recorded upgrade
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49}))
+	status, err = GetStatus(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, cfg.UpgradeBin("chain2"), status.CurrentBin)
+	require.NotNil(t, status.LastUpgrade)
+	assert.Equal(t, "chain2", status.LastUpgrade.Upgrade.Name)
+	assert.Equal(t, 49, status.LastUpgrade.Upgrade.Height)
+	for _, v := range status.Upgrades {
+		assert.Equal(t, v.Name == "chain2", v.Current, v.Name)
+	}
+
+	// a binary the launcher would refuse is not valid
+	require.NoError(t, os.Chmod(cfg.UpgradeBin("chain3"), 0777))
+	status, err = GetStatus(cfg)
+	require.NoError(t, err)
+	for _, v := range status.Upgrades {
+		if v.Name == "chain3" {
+			assert.False(t, v.Valid)
+			assert.Contains(t, v.Error, "writable")
+		}
+	}
+}
+
+func TestStatusCmd(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	os.Setenv("DAEMON_HOME", home)
+	os.Setenv("DAEMON_NAME", "dummyd")
+	defer os.Unsetenv("DAEMON_HOME")
+	defer os.Unsetenv("DAEMON_NAME")
+
+	var out bytes.Buffer
+	require.NoError(t, RunCommand("status", nil, []string{"-json"}, &out))
+	var status Status
+	require.NoError(t, json.Unmarshal(out.Bytes(), &status))
+	assert.Equal(t, "genesis", status.Genesis.Name)
+	assert.Len(t, status.Upgrades, 4)
+
+	out.Reset()
+	require.NoError(t, RunCommand("status", nil, nil, &out))
+	assert.Contains(t, out.String(), "Current binary: (not linked")
+	assert.Contains(t, out.String(), "noexec")
+}
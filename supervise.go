@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// restartBackoff is the delay before restarting an instance (or a sidecar) that exited, it doubles up to
+	// maxRestartBackoff while it keeps exiting (and is reset once it ran for longer than that)
+	restartBackoff    = time.Second
+	maxRestartBackoff = time.Minute
+	// instanceStopTimeout bounds how long a stopping instance may take to exit, it is longer than
+	// daemonStopTimeout so the instance gets to kill its daemon itself
+	instanceStopTimeout = 40 * time.Second
+)
+
+// instanceCommand returns the command running the cosmosd of an instance, tests replace it
+var instanceCommand = func(inst *Instance) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "finding cosmosd executable")
+	}
+	return exec.Command(self, inst.commandArgs()...), nil
+}
+
+// instanceEnv removes the settings of the supervisor from env, every instance gets its settings as options.
+// Only the supervisor talks to systemd.
+func instanceEnv(env []string) []string {
+	drop := map[string]bool{configEnv: true, notifySocketEnv: true, watchdogUsecEnv: true, watchdogPidEnv: true}
+	for _, s := range settings {
+		drop[s.env] = true
+	}
+	filtered := make([]string, 0, len(env))
+	for _, kv := range env {
+		if !drop[strings.SplitN(kv, "=", 2)[0]] {
+			filtered = append(filtered, kv)
+		}
+	}
+	return filtered
+}
+
+// Supervise runs a cosmosd for every instance, each upgrading its own daemon, until stop is closed.
+// An instance that exits (crashed, or after an upgrade) is restarted without affecting the others.
+// All output is copied to stdout and stderr, every line prefixed with the instance id.
+func Supervise(instances []*Instance, stdout, stderr io.Writer, stop <-chan struct{}) {
+	out, errOut := &lineWriter{w: stdout}, &lineWriter{w: stderr}
+	var running sync.WaitGroup
+	for _, inst := range instances {
+		running.Add(1)
+		go func(inst *Instance) {
+			defer running.Done()
+			superviseInstance(inst, out, errOut, stop)
+		}(inst)
+	}
+	notifySystemd(fmt.Sprintf("READY=1\nSTATUS=supervising %d instances", len(instances)))
+	stopWatchdog := startWatchdog()
+	running.Wait()
+	stopWatchdog()
+}
+
+func superviseInstance(inst *Instance, stdout, stderr *lineWriter, stop <-chan struct{}) {
+	backoff := restartBackoff
+	for {
+		start := time.Now()
+		err := runInstance(inst, stdout, stderr, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if time.Since(start) > maxRestartBackoff {
+			backoff = restartBackoff
+		}
+		if err != nil {
+			logger.Warn("instance exited, restarting", "instance", inst.ID, "error", err, "delay", backoff)
+		} else {
+			logger.Info("instance exited, restarting", "instance", inst.ID, "delay", backoff)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return
+		}
+		if backoff *= 2; backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+// runInstance runs the cosmosd of the instance until it exits, or stops it once stop is closed
+func runInstance(inst *Instance, stdout, stderr *lineWriter, stop <-chan struct{}) error {
+	cmd, err := instanceCommand(inst)
+	if err != nil {
+		return err
+	}
+	cmd.Env = append(instanceEnv(os.Environ()), inst.commandEnv()...)
+	exited, err := startPrefixed(cmd, "["+inst.ID+"] ", stdout, stderr)
+	if err != nil {
+		return errors.Wrapf(err, "starting instance %s", inst.ID)
+	}
+	logger.Info("instance started", "instance", inst.ID, "pid", cmd.Process.Pid)
+
+	select {
+	case err := <-exited:
+		return err
+	case <-stop:
+		return inst.stop(cmd, exited)
+	}
+}
+
+// stop passes SIGTERM to the cosmosd of the instance, which stops its daemon (and sidecars) and exits.
+// Only if it doesn't exit in time, it is killed along with its daemon.
+func (inst *Instance) stop(cmd *exec.Cmd, exited <-chan error) error {
+	logger.Info("stopping instance", "instance", inst.ID)
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(instanceStopTimeout):
+	}
+	logger.Warn("instance did not stop in time, killing it", "instance", inst.ID, "timeout", instanceStopTimeout)
+	if pid, ok := inst.Config.RunningDaemon(); ok {
+		_ = syscall.Kill(-pid, syscall.SIGKILL)
+	}
+	_ = killGroup(cmd)
+	return <-exited
+}
+
+// startPrefixed starts cmd in its own process group (so signals meant for us don't reach it, and it can be
+// stopped with everything it started), copying its output line by line with prefix.
+// The returned channel receives the result of Wait once all output is copied.
+func startPrefixed(cmd *exec.Cmd, prefix string, stdout, stderr *lineWriter) (<-chan error, error) {
+	startInGroup(cmd)
+	outpipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	errpipe, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var copying sync.WaitGroup
+	copying.Add(2)
+	go func() {
+		defer copying.Done()
+		stdout.copyLines(prefix, outpipe)
+	}()
+	go func() {
+		defer copying.Done()
+		stderr.copyLines(prefix, errpipe)
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		// Wait closes the pipes, so copy all output first
+		copying.Wait()
+		exited <- cmd.Wait()
+	}()
+	return exited, nil
+}
+
+// lineWriter writes whole lines, so the output of several processes doesn't interleave. Every process
+// writing to the same output must go through the same lineWriter.
+type lineWriter struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+func (l *lineWriter) copyLines(prefix string, r io.Reader) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			l.writeLine(prefix, line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeLine writes prefix and line, adding a newline if it has none. Errors are ignored, the process
+// writing the output must keep running.
+func (l *lineWriter) writeLine(prefix, line string) {
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, _ = io.WriteString(l.w, prefix+line)
+}
+
+// maxLineLength bounds the partial line a lineSplitter keeps, longer lines are split
+const maxLineLength = 1024 * 1024
+
+// lineSplitter is the writer exec copies the output of a process to. Every whole line is copied to out,
+// prefixed with prefix, and passed to onLine (if set) without its newline. Only one goroutine may write
+// to it, and flush passes on a last line without newline.
+type lineSplitter struct {
+	out     *lineWriter
+	prefix  string
+	onLine  func(line string)
+	partial []byte
+}
+
+// Write never fails, so the process keeps running whatever happens to its output
+func (s *lineSplitter) Write(p []byte) (int, error) {
+	s.partial = append(s.partial, p...)
+	lines := s.partial
+	for {
+		i := bytes.IndexByte(lines, '\n')
+		if i < 0 {
+			break
+		}
+		s.line(string(lines[:i+1]))
+		lines = lines[i+1:]
+	}
+	s.partial = append(s.partial[:0], lines...)
+	if len(s.partial) > maxLineLength {
+		s.flush()
+	}
+	return len(p), nil
+}
+
+func (s *lineSplitter) flush() {
+	if len(s.partial) > 0 {
+		s.line(string(s.partial))
+		s.partial = s.partial[:0]
+	}
+}
+
+func (s *lineSplitter) line(line string) {
+	s.out.writeLine(s.prefix, line)
+	if s.onLine != nil {
+		s.onLine(strings.TrimSuffix(line, "\n"))
+	}
+}
+
+// SuperviseCmd supervises all instances of an instances file until it receives SIGINT or SIGTERM:
+// `--cosmosd-supervise <instances-file>`
+func SuperviseCmd(opts Options, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(commandPrefix+"supervise", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: --cosmosd-supervise <instances-file>")
+	}
+
+	instances, err := LoadInstances(flags.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	// the log options on the command line apply to the supervisor as well
+	var cfg Config
+	logOpts := map[string]string{}
+	for _, key := range []string{"log_level", "log_format", "log_output"} {
+		if value, ok := opts[key]; ok {
+			logOpts[key] = value
+		}
+	}
+	if err := applySettings(&cfg, logOpts, "command line"); err != nil {
+		return err
+	}
+	l, err := OpenLogger(&cfg)
+	if err != nil {
+		return err
+	}
+	logger = l
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	stop := make(chan struct{})
+	go func() {
+		sig := <-signals
+		logger.Info("stopping all instances", "signal", sig)
+		close(stop)
+	}()
+	Supervise(instances, stdout, os.Stderr, stop)
+	return nil
+}
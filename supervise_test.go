@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHelperCosmosd runs cosmosd with the arguments after "--" when started by TestSupervise
+func TestHelperCosmosd(t *testing.T) {
+	if os.Getenv("COSMOSD_TEST_HELPER") != "1" {
+		return
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	if err := Run(args); err != nil {
+		logger.Error("cosmosd failed", "error", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	buf   bytes.Buffer
+	mutex sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestSupervise(t *testing.T) {
+	defer func(cmd func(*Instance) (*exec.Cmd, error), backoff time.Duration) {
+		instanceCommand, restartBackoff = cmd, backoff
+	}(instanceCommand, restartBackoff)
+	instanceCommand = func(inst *Instance) (*exec.Cmd, error) {
+		args := append([]string{"-test.run=TestHelperCosmosd", "--"}, inst.commandArgs()...)
+		return exec.Command(os.Args[0], args...), nil
+	}
+	restartBackoff = 10 * time.Millisecond
+	os.Setenv("COSMOSD_TEST_HELPER", "1")
+	defer os.Unsetenv("COSMOSD_TEST_HELPER")
+	// the settings of the supervisor don't leak into the instances
+	os.Setenv("DAEMON_NAME", "otherd")
+	defer os.Unsetenv("DAEMON_NAME")
+
+	path, homes := writeInstances(t, "")
+	for _, home := range homes {
+		defer os.RemoveAll(home)
+	}
+	instances, err := LoadInstances(path, nil)
+	require.NoError(t, err)
+
+	var stdout, stderr syncBuffer
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		Supervise(instances, &stdout, &stderr, stop)
+		close(done)
+	}()
+
+	// both instances upgrade independently, and are restarted once chain2 finishes
+	deadline := time.Now().Add(20 * time.Second)
+	for strings.Count(stdout.String(), "Finished successfully") < 4 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("supervisor did not stop")
+	}
+
+	out := stdout.String()
+	assert.Contains(t, out, "[first] Genesis foo 1\n")
+	assert.Contains(t, out, "[dummyd] Genesis\n")
+	assert.Contains(t, out, "[first] Chain 2 is live!\n")
+	assert.Contains(t, out, "[dummyd] Chain 2 is live!\n")
+	assert.Contains(t, out, "[first] Finished successfully\n")
+	assert.Contains(t, out, "[dummyd] Finished successfully\n")
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		assert.True(t, strings.HasPrefix(line, "[first] ") || strings.HasPrefix(line, "[dummyd] "), line)
+	}
+	for _, inst := range instances {
+		assertCurrentLink(t, *inst.Config, "upgrades/chain2")
+	}
+}
+
+func TestSuperviseStop(t *testing.T) {
+	defer func(cmd func(*Instance) (*exec.Cmd, error)) { instanceCommand = cmd }(instanceCommand)
+	// a cosmosd which ignores SIGTERM, and has no daemon to stop
+	instanceCommand = func(inst *Instance) (*exec.Cmd, error) {
+		script := "trap '' TERM; echo running; echo partial line >&2; printf 'no newline' >&2; exec sleep 30"
+		return exec.Command("sh", "-c", script), nil
+	}
+	defer func(timeout time.Duration) { instanceStopTimeout = timeout }(instanceStopTimeout)
+	instanceStopTimeout = 100 * time.Millisecond
+
+	path, homes := writeInstances(t, "")
+	for _, home := range homes {
+		defer os.RemoveAll(home)
+	}
+	instances, err := LoadInstances(path, nil)
+	require.NoError(t, err)
+
+	var stdout, stderr syncBuffer
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		Supervise(instances[:1], &stdout, &stderr, stop)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not kill the instance")
+	}
+	assert.Equal(t, "[first] running\n", stdout.String())
+	assert.Equal(t, "[first] partial line\n[first] no newline\n", stderr.String())
+}
+
+func TestSuperviseStopSignalsInstance(t *testing.T) {
+	defer func(cmd func(*Instance) (*exec.Cmd, error)) { instanceCommand = cmd }(instanceCommand)
+	// a cosmosd which cleans up on SIGTERM
+	instanceCommand = func(inst *Instance) (*exec.Cmd, error) {
+		script := "trap 'echo cleaning up; exit 0' TERM; echo running; while true; do sleep 0.1; done"
+		return exec.Command("sh", "-c", script), nil
+	}
+
+	path, homes := writeInstances(t, "")
+	for _, home := range homes {
+		defer os.RemoveAll(home)
+	}
+	instances, err := LoadInstances(path, nil)
+	require.NoError(t, err)
+
+	var stdout, stderr syncBuffer
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		Supervise(instances[:1], &stdout, &stderr, stop)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("instance did not stop")
+	}
+	assert.Equal(t, "[first] running\n[first] cleaning up\n", stdout.String())
+}
+
+func TestInstanceEnv(t *testing.T) {
+	env := []string{"PATH=/bin", "DAEMON_HOME=/home", "DAEMON_CONFIG=/etc/c.yaml", "NOTIFY_SOCKET=@sd", "DAEMON_FOO=bar"}
+	assert.Equal(t, []string{"PATH=/bin", "DAEMON_FOO=bar"}, instanceEnv(env))
+}
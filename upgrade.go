@@ -1,14 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"debug/elf"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	getter "github.com/hashicorp/go-getter"
 	"github.com/pkg/errors"
@@ -18,60 +22,159 @@ import (
 // We can now make any changes to the underlying directory without interference and leave it
 // in a state, so we can make a proper restart
 func DoUpgrade(cfg *Config, info *UpgradeInfo) error {
-	err := EnsureBinary(cfg.UpgradeBin(info.Name))
+	start := time.Now()
+	oldTarget, _ := cfg.CurrentDir()
+
+	source, err := prepareUpgrade(cfg, info)
+	if err == nil && cfg.RequireApproval {
+		err = cfg.waitForApproval(info)
+	}
+	if err == nil {
+		err = cfg.checkDiskSpace(0, "upgrade "+info.Name)
+	}
+	if err == nil {
+		notifyStatus("switching to " + info.Name)
+		err = cfg.SetCurrentUpgrade(info.Name)
+	}
+	cfg.appendHistory(HistoryRecord{
+		Event:     EventSwitch,
+		Upgrade:   info,
+		OldTarget: oldTarget,
+		NewTarget: cfg.UpgradeDir(info.Name),
+		Source:    source,
+	}, start, err)
+	metrics.UpgradeDone(err)
+	if err != nil {
+		logger.Error("upgrade failed", "upgrade", info.Name, "error", err)
+		notifyStatus("upgrade " + info.Name + " failed: " + err.Error())
+		return err
+	}
+	logger.Info("switched to upgrade", "upgrade", info.Name, "from", oldTarget, "to", cfg.UpgradeDir(info.Name))
+	cfg.notify(Notification{Event: NotifySwitchSucceeded, Upgrade: info, Target: cfg.UpgradeDir(info.Name)}, nil)
+
+	if cfg.RetainUpgrades > 0 {
+		// pruning is best effort, it must never fail an upgrade that already happened
+		res, err := Prune(cfg, cfg.RetainUpgrades, false)
+		if err != nil {
+			logger.Warn("pruning old upgrades failed", "error", err)
+		} else if len(res.Removed) > 0 {
+			logger.Info("pruned old upgrades", "removed", strings.Join(res.Removed, ","), "reclaimed_bytes", res.Reclaimed)
+		}
+	}
+	return nil
+}
+
+// prepareUpgrade makes sure the binary for the upgrade is in place, downloading it if allowed.
+// It returns the url the binary was downloaded from, or "" if it was already installed.
+func prepareUpgrade(cfg *Config, info *UpgradeInfo) (string, error) {
+	err := cfg.checkBinary(cfg.UpgradeBin(info.Name))
 
 	// Simplest case is to switch the link
 	if err == nil {
 		// we have the binary - do it
-		return cfg.SetCurrentUpgrade(info.Name)
+		return "", nil
 	}
 
+	cfg.notify(Notification{Event: NotifyBinaryMissing, Upgrade: info, Target: cfg.UpgradeDir(info.Name)}, err)
+
 	// if auto-download is disabled, we fail
 	if !cfg.AllowDownloadBinaries {
-		return errors.Wrap(err, "binary not present, downloading disabled")
+		return "", errors.Wrap(err, "binary not present, downloading disabled")
 	}
 	// if the dir is there already, don't download either
 	_, err = os.Stat(cfg.UpgradeDir(info.Name))
 	if !os.IsNotExist(err) {
-		return errors.Errorf("upgrade dir already exists, won't overwrite")
+		return "", errors.Errorf("upgrade dir already exists, won't overwrite")
 	}
 
 	// If not there, then we try to download it... maybe
-	if err := DownloadBinary(cfg, info); err != nil {
-		return errors.Wrap(err, "cannot download binary")
+	url, err := downloadUpgrade(cfg, info)
+	if err != nil {
+		return url, errors.Wrap(err, "cannot download binary")
 	}
 
 	// and then set the binary again
-	err = EnsureBinary(cfg.UpgradeBin(info.Name))
+	err = cfg.checkBinary(cfg.UpgradeBin(info.Name))
 	if err != nil {
-		return errors.Wrap(err, "downloaded binary doesn't check out")
+		return url, errors.Wrap(err, "downloaded binary doesn't check out")
 	}
-	return cfg.SetCurrentUpgrade(info.Name)
+	return url, nil
 }
 
 // DownloadBinary will grab the binary and place it in the proper directory
 func DownloadBinary(cfg *Config, info *UpgradeInfo) error {
+	_, err := downloadUpgrade(cfg, info)
+	return err
+}
+
+// downloadUpgrade downloads the binary and records the attempt in the history.
+// It returns the url it downloaded from.
+func downloadUpgrade(cfg *Config, info *UpgradeInfo) (string, error) {
+	start := time.Now()
 	url, err := GetDownloadURL(info)
-	if err != nil {
-		return err
+	if err == nil {
+		err = cfg.checkDiskSpace(artifactSize(url, ""), "downloading "+info.Name)
 	}
+	if err == nil {
+		logger.Info("downloading upgrade", "upgrade", info.Name, "url", url)
+		notifyStatus("downloading " + info.Name)
+		cfg.notify(Notification{Event: NotifyDownloadStarted, Upgrade: info, Message: url}, nil)
+		err = fetchVersion(cfg.UpgradeDir(info.Name), cfg.Name, url)
+	}
+	var size int64
+	if err == nil {
+		size, _ = dirSize(cfg.UpgradeDir(info.Name))
+		metrics.Downloaded(size, time.Since(start))
+		logger.Info("downloaded upgrade", "upgrade", info.Name, "bytes", size, "duration", time.Since(start))
+	} else {
+		logger.Error("download failed", "upgrade", info.Name, "url", url, "error", err)
+		cfg.notify(Notification{Event: NotifyDownloadFailed, Upgrade: info, Message: url}, err)
+	}
+	cfg.appendHistory(HistoryRecord{
+		Event:     EventDownload,
+		Upgrade:   info,
+		NewTarget: cfg.UpgradeDir(info.Name),
+		Source:    url,
+		Bytes:     size,
+	}, start, err)
+	return url, err
+}
 
+// fetchVersion downloads src into the version directory dir. src may be a single binary, which is
+// stored as bin/$name, or an archive of the whole version directory. Either way, the binary is then
+// marked executable.
+func fetchVersion(dir, name, src string, opts ...getter.ClientOption) error {
+	opts = append(opts, copyLocalFiles)
 	// download into the bin dir (works for one file)
-	binPath := cfg.UpgradeBin(info.Name)
-	err = getter.GetFile(binPath, url)
+	binPath := filepath.Join(dir, "bin", name)
+	err := getter.GetFile(binPath, src, opts...)
 
 	// if this fails, let's see if it is a zipped directory
 	if err != nil {
-		dirPath := cfg.UpgradeDir(info.Name)
-		err = getter.Get(dirPath, url)
+		err = getter.Get(dir, src, opts...)
 	}
 	if err != nil {
 		return err
 	}
+	// downloads are created according to the umask, make sure only we can modify them
+	if err := restrictPermissions(dir); err != nil {
+		return errors.Wrap(err, "restricting permissions")
+	}
 	// if it is successful, let's ensure the binary is executable
 	return MarkExecutable(binPath)
 }
 
+// copyLocalFiles makes go-getter copy local files rather than symlink them,
+// so the version directory doesn't depend on where the source file was
+func copyLocalFiles(c *getter.Client) error {
+	c.Getters = make(map[string]getter.Getter, len(getter.Getters))
+	for scheme, g := range getter.Getters {
+		c.Getters[scheme] = g
+	}
+	c.Getters["file"] = &getter.FileGetter{Copy: true}
+	return nil
+}
+
 // MarkExecutable will try to set the executable bits if not already set
 // Fails if file doesn't exist or we cannot set those bits
 func MarkExecutable(path string) error {
@@ -79,8 +182,8 @@ func MarkExecutable(path string) error {
 	if err != nil {
 		return errors.Wrap(err, "stating binary")
 	}
-	// end early if world exec already set
-	if info.Mode()&0001 == 1 {
+	// end early if we can already run it
+	if executable(info) {
 		return nil
 	}
 	// now try to set all exec bits
@@ -138,29 +241,60 @@ func osArch() string {
 func (cfg *Config) SetCurrentUpgrade(upgradeName string) error {
 	// ensure named upgrade exists
 	bin := cfg.UpgradeBin(upgradeName)
-	if err := EnsureBinary(bin); err != nil {
+	if err := cfg.checkBinary(bin); err != nil {
 		return err
 	}
 
-	// set a symbolic link
-	link := filepath.Join(cfg.Root(), currentLink)
-	safeName := url.PathEscape(upgradeName)
-	upgrade := filepath.Join(cfg.Root(), upgradesDir, safeName)
+	return cfg.switchCurrent(cfg.UpgradeDir(upgradeName))
+}
 
-	// remove link if it exists
-	if _, err := os.Stat(link); err == nil {
-		os.Remove(link)
+// switchCurrent atomically points current to the version directory dir.
+// The old target is remembered as previous, so it can be rolled back to.
+func (cfg *Config) switchCurrent(dir string) error {
+	if old, err := cfg.CurrentDir(); err == nil && old != dir {
+		if err := replaceSymlink(old, filepath.Join(cfg.Root(), previousLink)); err != nil {
+			return errors.Wrap(err, "recording previous version")
+		}
 	}
-
-	// point to the new directory
-	if err := os.Symlink(upgrade, link); err != nil {
+	link := filepath.Join(cfg.Root(), currentLink)
+	if err := replaceSymlink(dir, link); err != nil {
 		return errors.Wrap(err, "creating current symlink")
 	}
+	// remember when this version was last used, so prune knows which versions are old
+	stamp := []byte(time.Now().UTC().Format(time.RFC3339))
+	if err := ioutil.WriteFile(filepath.Join(dir, activatedFile), stamp, 0644); err != nil {
+		return errors.Wrap(err, "marking version as activated")
+	}
+	return nil
+}
+
+// replaceSymlink creates a symlink at link pointing to target, replacing any existing one
+// with a rename, so link is always either the old or the new symlink
+func replaceSymlink(target, link string) error {
+	tmp := link + ".tmp"
+	// clean up after any earlier interrupted attempt
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
 	return nil
 }
 
-// EnsureBinary ensures the file exists and is executable, or returns an error
+// EnsureBinary ensures the file exists, is executable and runs on this host (an ELF binary for
+// this architecture, or a script), or returns an error
 func EnsureBinary(path string) error {
+	if err := ensureExecutable(path); err != nil {
+		return err
+	}
+	return checkArch(path)
+}
+
+// ensureExecutable checks path is a regular file we (the effective uid and gids) may execute
+func ensureExecutable(path string) error {
 	info, err := os.Stat(path)
 	if err != nil {
 		return errors.Wrap(err, "cannot stat home dir")
@@ -168,10 +302,80 @@ func EnsureBinary(path string) error {
 	if !info.Mode().IsRegular() {
 		return errors.Errorf("%s is not a regular file", info.Name())
 	}
-	// this checks if the world-executable bit is set (we cannot check owner easily)
-	exec := info.Mode().Perm() & 0001
-	if exec == 0 {
-		return errors.Errorf("%s is not world executable", info.Name())
+	if !executable(info) {
+		return errors.Errorf("%s is not executable by uid %d", info.Name(), os.Geteuid())
+	}
+	return nil
+}
+
+// elfMachines maps GOARCH to the elf machine and class of a native binary
+var elfMachines = map[string]struct {
+	machine elf.Machine
+	class   elf.Class
+}{
+	"386":     {elf.EM_386, elf.ELFCLASS32},
+	"amd64":   {elf.EM_X86_64, elf.ELFCLASS64},
+	"arm":     {elf.EM_ARM, elf.ELFCLASS32},
+	"arm64":   {elf.EM_AARCH64, elf.ELFCLASS64},
+	"ppc64le": {elf.EM_PPC64, elf.ELFCLASS64},
+	"s390x":   {elf.EM_S390, elf.ELFCLASS64},
+}
+
+// foreignFormats recognises binaries for other operating systems by their magic bytes
+var foreignFormats = []struct {
+	magic  string
+	format string
+}{
+	{"\xfe\xed\xfa\xce", "a Mach-O binary (macOS)"},
+	{"\xfe\xed\xfa\xcf", "a Mach-O binary (macOS)"},
+	{"\xce\xfa\xed\xfe", "a Mach-O binary (macOS)"},
+	{"\xcf\xfa\xed\xfe", "a Mach-O binary (macOS)"},
+	{"\xca\xfe\xba\xbe", "a universal Mach-O binary (macOS)"},
+	{"MZ", "a PE binary (Windows)"},
+	{"PK", "a zip archive"},
+	{"\x1f\x8b", "a gzip archive"},
+}
+
+// checkArch ensures an ELF binary was built for this host, so we find out before current is switched to it
+// rather than when it fails to start. Scripts (#!) are accepted as is.
+func checkArch(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// a file shorter than the magic number is simply not in a format we recognise
+	magic, err := bufio.NewReader(f).Peek(4)
+	if err != nil && err != io.EOF {
+		return errors.Wrapf(err, "reading %s", path)
+	}
+	if strings.HasPrefix(string(magic), "#!") {
+		return nil
+	}
+	if string(magic) != elf.ELFMAG {
+		for _, foreign := range foreignFormats {
+			if strings.HasPrefix(string(magic), foreign.magic) {
+				return errors.Errorf("%s is %s, not an ELF binary for %s", path, foreign.format, osArch())
+			}
+		}
+		return errors.Errorf("%s is neither an ELF binary nor a script", path)
+	}
+
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return errors.Wrapf(err, "parsing ELF header of %s", path)
+	}
+	if ef.Type != elf.ET_EXEC && ef.Type != elf.ET_DYN {
+		return errors.Errorf("%s is an ELF %s, not an executable", path, ef.Type)
+	}
+	expected, ok := elfMachines[runtime.GOARCH]
+	if !ok {
+		// we don't know what to expect, so don't fail on it
+		return nil
+	}
+	if ef.Machine != expected.machine || ef.Class != expected.class {
+		return errors.Errorf("%s is built for %s %s, but this host is %s", path, ef.Class, ef.Machine, osArch())
 	}
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 
@@ -282,5 +283,76 @@ func copyTestData(subdir string) (string, error) {
 		os.RemoveAll(tmpdir)
 		return "", errors.Wrap(err, "copying files")
 	}
+	// the copies follow the umask, but binaries are refused if others may modify them
+	if err := restrictPermissions(tmpdir); err != nil {
+		os.RemoveAll(tmpdir)
+		return "", errors.Wrap(err, "restricting permissions")
+	}
 	return tmpdir, nil
 }
+
+func TestCheckArch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check-arch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the test binary itself is built for this host
+	self, err := os.Executable()
+	require.NoError(t, err)
+	assert.NoError(t, checkArch(self))
+
+	// scripts are fine
+	assert.NoError(t, checkArch(filepath.Join("testdata", "repo", "raw_binary", "autod")))
+
+	// random data is not
+	text := filepath.Join(dir, "text")
+	require.NoError(t, ioutil.WriteFile(text, []byte("hello world"), 0755))
+	assert.Error(t, checkArch(text))
+	assert.Error(t, EnsureBinary(text))
+	// as are files shorter than any magic number
+	for _, content := range []string{"", "\x7f", "hi"} {
+		short := filepath.Join(dir, "short")
+		require.NoError(t, ioutil.WriteFile(short, []byte(content), 0755))
+		err = checkArch(short)
+		require.Error(t, err, "%q", content)
+		assert.Contains(t, err.Error(), "is neither an ELF binary nor a script")
+	}
+
+	// binaries for other systems are recognised
+	macho := filepath.Join(dir, "macho")
+	require.NoError(t, ioutil.WriteFile(macho, []byte("\xcf\xfa\xed\xfe\x07\x00\x00\x01"), 0755))
+	err = checkArch(macho)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is a Mach-O binary (macOS), not an ELF binary for "+osArch())
+	archive := filepath.Join(dir, "archive")
+	zipped, err := ioutil.ReadFile(filepath.Join("testdata", "repo", "zip_binary", "autod.zip"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(archive, zipped, 0755))
+	assert.Contains(t, checkArch(archive).Error(), "is a zip archive")
+
+	// patch the machine type in the elf header to another architecture
+	if runtime.GOARCH != "amd64" {
+		t.Skip("foreign binary is only built for amd64 hosts")
+	}
+	bz, err := ioutil.ReadFile(self)
+	require.NoError(t, err)
+	bz[18], bz[19] = 183, 0 // EM_AARCH64, little endian
+	foreign := filepath.Join(dir, "foreign")
+	require.NoError(t, ioutil.WriteFile(foreign, bz, 0755))
+	err = checkArch(foreign)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "EM_AARCH64")
+	// and EnsureBinary refuses it
+	err = EnsureBinary(foreign)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "but this host is linux/amd64")
+
+	// an object file is not an executable
+	bz[18], bz[19] = 62, 0 // back to EM_X86_64
+	bz[16], bz[17] = 1, 0  // ET_REL
+	object := filepath.Join(dir, "object")
+	require.NoError(t, ioutil.WriteFile(object, bz, 0755))
+	err = checkArch(object)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ET_REL")
+}
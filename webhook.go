@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// webhook events
+const (
+	NotifyUpgradeDetected  = "upgrade_detected"
+	NotifyBinaryMissing    = "binary_missing"
+	NotifyDownloadStarted  = "download_started"
+	NotifyDownloadFailed   = "download_failed"
+	NotifySwitchSucceeded  = "switch_succeeded"
+	NotifyDaemonCrashed    = "daemon_crashed"
+	NotifyRollback         = "rollback"
+	NotifyApprovalRequired = "approval_required"
+)
+
+const (
+	// signatureHeader holds the hex encoded HMAC-SHA256 of the body, keyed with the webhook secret
+	signatureHeader = "X-Cosmosd-Signature"
+	webhookAttempts = 4
+	webhookTimeout  = 10 * time.Second
+	// notifyFlushTimeout bounds how long the upgrade manager waits for pending notifications before exiting,
+	// which is enough for a healthy webhook while a dead one barely delays the restart of the daemon
+	notifyFlushTimeout = 2 * time.Second
+)
+
+var (
+	// webhookBackoff is the delay before the first retry, it doubles after every failed attempt
+	webhookBackoff = time.Second
+	webhookClient  = &http.Client{Timeout: webhookTimeout}
+	// pendingNotifications tracks deliveries in flight, see FlushNotifications
+	pendingNotifications deliveries
+)
+
+// deliveries counts the notifications in flight. Unlike a sync.WaitGroup, it can be waited on
+// with a timeout while new deliveries are started.
+type deliveries struct {
+	mutex   sync.Mutex
+	pending int
+	idle    []chan struct{}
+}
+
+func (d *deliveries) start() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.pending++
+}
+
+func (d *deliveries) done() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.pending--
+	if d.pending == 0 {
+		for _, ch := range d.idle {
+			close(ch)
+		}
+		d.idle = nil
+	}
+}
+
+// wait returns a channel which is closed once no deliveries are pending
+func (d *deliveries) wait() <-chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ch := make(chan struct{})
+	if d.pending == 0 {
+		close(ch)
+	} else {
+		d.idle = append(d.idle, ch)
+	}
+	return ch
+}
+
+// Notification is the json payload posted to the webhooks
+type Notification struct {
+	Event   string       `json:"event"`
+	Time    time.Time    `json:"time"`
+	Daemon  string       `json:"daemon"`
+	Home    string       `json:"home"`
+	Upgrade *UpgradeInfo `json:"upgrade,omitempty"`
+	// Target is the version directory the event is about
+	Target  string `json:"target,omitempty"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// notify posts the event to all configured webhooks in the background, so a slow or dead
+// webhook never delays the upgrade. Failed deliveries are retried, and logged in the end.
+func (cfg *Config) notify(n Notification, err error) {
+	if len(cfg.WebhookURLs) == 0 {
+		return
+	}
+	n.Time = time.Now().UTC()
+	n.Daemon = cfg.Name
+	n.Home = cfg.Home
+	if err != nil {
+		n.Error = err.Error()
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		logger.Error("encoding notification failed", "event", n.Event, "error", err)
+		return
+	}
+	for _, url := range cfg.WebhookURLs {
+		pendingNotifications.start()
+		go func(url string) {
+			defer pendingNotifications.done()
+			if err := deliver(url, cfg.WebhookSecret, body); err != nil {
+				logger.Warn("webhook delivery failed", "event", n.Event, "url", url, "error", err)
+			}
+		}(url)
+	}
+}
+
+// deliver posts body to url, retrying with exponential backoff until a 2xx response
+func deliver(url, secret string, body []byte) error {
+	var err error
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if err = post(url, secret, body); err == nil {
+			return nil
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return errors.Wrapf(err, "giving up after %d attempts", webhookAttempts)
+}
+
+func post(url, secret string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(signatureHeader, "sha256="+Signature(secret, body))
+	}
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// Signature is the hex encoded HMAC-SHA256 of body, which receivers can use to verify notifications
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// FlushNotifications waits up to timeout for the pending notifications to be delivered.
+// It returns false if some are still pending.
+func FlushNotifications(timeout time.Duration) bool {
+	select {
+	case <-pendingNotifications.wait():
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
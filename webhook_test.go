@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookRecorder is a webhook receiving notifications, which fails the first failures requests
+type webhookRecorder struct {
+	mutex    sync.Mutex
+	failures int
+	requests int
+	received []Notification
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func (w *webhookRecorder) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.requests++
+	if w.requests <= w.failures {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var n Notification
+	if err := json.Unmarshal(body, &n); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.received = append(w.received, n)
+	w.bodies = append(w.bodies, body)
+	w.headers = append(w.headers, req.Header)
+}
+
+func (w *webhookRecorder) events() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var events []string
+	for _, n := range w.received {
+		events = append(events, n.Event)
+	}
+	return events
+}
+
+func TestNotify(t *testing.T) {
+	defer func(d time.Duration) { webhookBackoff = d }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	good, flaky := &webhookRecorder{}, &webhookRecorder{failures: 2}
+	goodServer, flakyServer := httptest.NewServer(good), httptest.NewServer(flaky)
+	defer goodServer.Close()
+	defer flakyServer.Close()
+
+	cfg := &Config{Home: "/home/node", Name: "dummyd", WebhookURLs: []string{goodServer.URL, flakyServer.URL}, WebhookSecret: "s3cret"}
+	cfg.notify(Notification{Event: NotifyUpgradeDetected, Upgrade: &UpgradeInfo{Name: "chain2", Height: 49}}, nil)
+	require.True(t, FlushNotifications(5*time.Second))
+
+	require.Len(t, good.received, 1)
+	n := good.received[0]
+	assert.Equal(t, NotifyUpgradeDetected, n.Event)
+	assert.Equal(t, "dummyd", n.Daemon)
+	assert.Equal(t, "/home/node", n.Home)
+	assert.Equal(t, &UpgradeInfo{Name: "chain2", Height: 49}, n.Upgrade)
+	assert.False(t, n.Time.IsZero())
+	assert.Equal(t, "application/json", good.headers[0].Get("Content-Type"))
+	assert.Equal(t, "sha256="+Signature("s3cret", good.bodies[0]), good.headers[0].Get(signatureHeader))
+	assert.NotEqual(t, Signature("other", good.bodies[0]), Signature("s3cret", good.bodies[0]))
+
+	// delivered on the third attempt
+	assert.Equal(t, 3, flaky.requests)
+	require.Len(t, flaky.received, 1)
+
+	// give up eventually
+	dead := &webhookRecorder{failures: 100}
+	deadServer := httptest.NewServer(dead)
+	defer deadServer.Close()
+	err := deliver(deadServer.URL, "", []byte("{}"))
+	require.Error(t, err)
+	assert.Equal(t, webhookAttempts, dead.requests)
+}
+
+func TestNotifyDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer hanging.Close()
+	defer close(release)
+
+	cfg := &Config{Name: "dummyd", WebhookURLs: []string{hanging.URL}}
+	start := time.Now()
+	cfg.notify(Notification{Event: NotifyRollback}, nil)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.False(t, FlushNotifications(50*time.Millisecond))
+}
+
+func TestUpgradeNotifications(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	hook := &webhookRecorder{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	cfg := &Config{Home: home, Name: "dummyd", WebhookURLs: []string{server.URL}}
+
+	var stdout, stderr bytes.Buffer
+	doUpgrade, err := LaunchProcess(cfg, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	require.True(t, doUpgrade)
+	require.True(t, FlushNotifications(5*time.Second))
+	// the order of deliveries is not guaranteed
+	assert.ElementsMatch(t, []string{NotifyUpgradeDetected, NotifySwitchSucceeded}, hook.events())
+
+	require.Error(t, DoUpgrade(cfg, &UpgradeInfo{Name: "noexec"}))
+	_, err = cfg.Rollback()
+	require.NoError(t, err)
+	require.True(t, FlushNotifications(5*time.Second))
+	assert.ElementsMatch(t, []string{NotifyUpgradeDetected, NotifySwitchSucceeded, NotifyBinaryMissing, NotifyRollback}, hook.events())
+}